@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pschou/go-params"
+)
+
+// Collector is a named set of metrics which can be switched on or off from
+// the command line with --collector.<name> and --no-collector.<name>.
+type Collector struct {
+	Name    string
+	Help    string
+	Enabled bool
+	Timeout time.Duration // zero uses --collector.timeout
+	After   []string      // collectors whose results this one uses
+	Collect func(*Metrics) error
+
+	chosen bool // named with --collector.<name>
+}
+
+// collectorTimeout is the deadline of collectors without one of their own.
+var collectorTimeout = 10 * time.Second
+
+func (c *Collector) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return collectorTimeout
+}
+
+// Collectors run side by side and their metrics are merged in this order.
+// The container labels from docker are used by the netdev and cgroup walks,
+// and systemd waits on memory and stat which discover the service list.
+var Collectors = []*Collector{
+	{Name: "docker", Help: "Docker container state", Enabled: true, Collect: (*Metrics).CollectDocker},
+	{Name: "loadavg", Help: "Load averages", Enabled: true, Collect: (*Metrics).CollectLoadavg},
+	{Name: "filefd", Help: "File descriptor usage", Enabled: true, Collect: (*Metrics).CollectFilefd},
+	{Name: "conntrack", Help: "Connection tracking table usage", Enabled: true, Collect: (*Metrics).CollectNfConntrack},
+	{Name: "netstat", Help: "Network statistics from /proc/net/netstat and snmp", Enabled: true, Collect: (*Metrics).CollectNetstat},
+	{Name: "sockstat", Help: "Socket statistics", Enabled: true, Collect: (*Metrics).CollectSockstat},
+	{Name: "vmstat", Help: "Virtual memory statistics", Enabled: true, Collect: (*Metrics).CollectVmstat},
+	{Name: "arp", Help: "ARP entries by device", Enabled: true, Collect: (*Metrics).CollectArp},
+	{Name: "entropy", Help: "Available entropy", Enabled: true, Collect: (*Metrics).CollectEntropy},
+	{Name: "threads", Help: "Thread, pid and map count limits", Enabled: true, Collect: (*Metrics).CollectThreads},
+	{Name: "netdev", Help: "Network device statistics, per host and per container", Enabled: true, After: []string{"docker"}, Collect: (*Metrics).CollectNetdevAll},
+	{Name: "nftables", Help: "nftables rule counters (runs nft)", Enabled: true, Collect: (*Metrics).CollectNFTables},
+	{Name: "diskstats", Help: "Disk and blkio cgroup statistics", Enabled: true, After: []string{"docker"}, Collect: (*Metrics).CollectDiskstats},
+	{Name: "stat", Help: "CPU, boot time and cpu cgroup statistics", Enabled: true, After: []string{"docker"}, Collect: (*Metrics).CollectStat},
+	{Name: "memory", Help: "Memory and memory cgroup statistics", Enabled: true, After: []string{"docker"}, Collect: (*Metrics).CollectMemory},
+	{Name: "systemd", Help: "Systemd unit state (runs systemctl)", Enabled: true, After: []string{"memory", "stat"}, Collect: (*Metrics).CollectSystemd},
+	{Name: "kernel", Help: "Kernel and system release (runs uname)", Enabled: true, Collect: (*Metrics).CollectKernel},
+	{Name: "filesystem", Help: "Filesystem usage (runs df)", Enabled: true, Collect: (*Metrics).CollectFilesystem},
+	{Name: "textfile", Help: "Metrics from *.prom files in --collector.textfile.directory", Enabled: true, Collect: (*Metrics).CollectTextfile},
+	{Name: "script", Help: "Metrics printed by the scripts in --collector.script.file", Enabled: true, Collect: (*Metrics).CollectScript},
+	{Name: "tunnel", Help: "Health of the tunnels in --config.file", Enabled: true, Collect: (*Metrics).CollectTunnel},
+	{Name: "time", Help: "System time", Enabled: false, Collect: (*Metrics).CollectTime},
+}
+
+// CollectorFlags registers the enable/disable and timeout parameters for
+// every collector.
+func CollectorFlags() {
+	params.GroupingSet("Collector")
+	params.DurationVar(&collectorTimeout, "collector.timeout", collectorTimeout, "Time each collector is given before it is abandoned", "DURATION")
+	params.StringVar(&textfileDirectory, "collector.textfile.directory", textfileDirectory, "Directory to read *.prom text files with metrics from", "DIR")
+	params.FlagFunc("collector.script.file", "Script printing metrics to run on each scrape, on the SSH host when there is one (may be repeated)", "FILE", 1,
+		func(v []string) error { scriptFiles = append(scriptFiles, v...); return nil })
+	for _, c := range Collectors {
+		c := c
+		state := "disabled"
+		if c.Enabled {
+			state = "enabled"
+		}
+		params.FlagFunc("collector."+c.Name, fmt.Sprintf("Enable the %s collector (%s)", c.Name, state), "", 0,
+			func([]string) error { c.Enabled, c.chosen = true, true; return nil })
+		params.FlagFunc("no-collector."+c.Name, fmt.Sprintf("Disable the %s collector", c.Name), "", 0,
+			func([]string) error { c.Enabled, c.chosen = false, false; return nil })
+		params.DurationVar(&c.Timeout, "collector."+c.Name+".timeout", c.Timeout, fmt.Sprintf("Timeout for the %s collector (default --collector.timeout)", c.Name), "DURATION")
+	}
+	params.GroupingSet("")
+}
+
+// ChosenCollectorsOnly disables the collectors enabled by default but not
+// named with --collector.<name>, and reports whether any are left.
+func ChosenCollectorsOnly() bool {
+	left := false
+	for _, c := range Collectors {
+		c.Enabled = c.chosen
+		left = left || c.chosen
+	}
+	return left
+}
+
+// ListCollectors prints the collectors and their state after parsing the
+// command line.
+func ListCollectors() {
+	for _, c := range Collectors {
+		state := "disabled"
+		if c.Enabled {
+			state = "enabled"
+		}
+		fmt.Printf("%-12s %-9s %s\n", c.Name, state, c.Help)
+	}
+}
+
+// scrapeTimeout is the deadline of a whole scrape: that of the slowest
+// enabled collector, which those waiting on others must finish within too.
+func scrapeTimeout() time.Duration {
+	var d time.Duration
+	for _, c := range Collectors {
+		if c.Enabled && c.timeout() > d {
+			d = c.timeout()
+		}
+	}
+	if d == 0 {
+		return collectorTimeout
+	}
+	return d
+}
+
+// collectorResult is what one collector produced and how long it took.  The
+// metrics are nil when the collector failed, so no half of a family is shown
+// beside its failure.
+type collectorResult struct {
+	collector *Collector
+	metrics   *Metrics
+	duration  time.Duration
+	err       error
+}
+
+// runCollectors runs the enabled collectors concurrently, each on its own
+// Metrics and with its own deadline, and returns the results in the order of
+// Collectors.  A collector starts once those it runs after are done or have
+// timed out, unless the deadline of the scrape has passed by then.
+func (m *Metrics) runCollectors() []collectorResult {
+	var enabled []*Collector
+	done := make(map[string]chan struct{})
+	for _, c := range Collectors {
+		if c.Enabled {
+			enabled = append(enabled, c)
+			done[c.Name] = make(chan struct{})
+		}
+	}
+
+	m.shared() // started here, before the collectors share it
+	results := make([]collectorResult, len(enabled))
+	var wg sync.WaitGroup
+	for i, c := range enabled {
+		wg.Add(1)
+		go func(i int, c *Collector) {
+			defer wg.Done()
+			defer close(done[c.Name])
+			start := time.Now()
+			for _, name := range c.After {
+				if ch, ok := done[name]; ok {
+					select {
+					case <-ch:
+					case <-m.context().Done():
+					}
+				}
+			}
+			if err := m.context().Err(); err != nil {
+				results[i] = collectorResult{collector: c, duration: time.Since(start), err: fmt.Errorf("not started: %v", err)}
+				return
+			}
+			results[i] = m.runCollector(c)
+		}(i, c)
+	}
+	wg.Wait()
+	return results
+}
+
+func (m *Metrics) runCollector(c *Collector) collectorResult {
+	ctx, cancel := context.WithTimeout(m.context(), c.timeout())
+	defer cancel()
+
+	sub := &Metrics{Client: m.Client, FS: m.FS, Format: m.Format, Timestamp: m.Timestamp, ctx: ctx, scrape: m.scrape}
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() {
+		// A panic fails this collector rather than the whole process
+		defer func() {
+			if r := recover(); r != nil {
+				errc <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		errc <- c.Collect(sub)
+	}()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			return collectorResult{collector: c, duration: time.Since(start), err: err}
+		}
+		return collectorResult{collector: c, metrics: sub, duration: time.Since(start)}
+	case <-ctx.Done():
+		// The collector may still be writing to sub, so it is left behind.
+		// Its context is done, so its commands are killed, and all else it
+		// can touch is its own sub and the locked state of this scrape.
+		return collectorResult{collector: c, duration: time.Since(start), err: fmt.Errorf("timed out after %v", time.Since(start).Round(time.Millisecond))}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	apitypes "github.com/docker/docker/api/types"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+const fixtureRoot = "testdata/fixtures"
+
+// fixtureFS replays a captured host from a directory tree.  Commands are
+// answered from files under exec/ named after the command line.
+type fixtureFS struct {
+	root string
+}
+
+func (f fixtureFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(f.root, name))
+}
+
+func (f fixtureFS) ReadDir(name string) ([]string, error) {
+	return LocalFS{}.ReadDir(filepath.Join(f.root, name))
+}
+
+// fixtureMtime stands in for the modification time of every fixture, which
+// git does not keep.
+var fixtureMtime = time.Unix(1792300000, 0)
+
+func (f fixtureFS) ModTime(name string) (time.Time, error) {
+	if _, err := os.Stat(filepath.Join(f.root, name)); err != nil {
+		return time.Time{}, err
+	}
+	return fixtureMtime, nil
+}
+
+func (f fixtureFS) Walk(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(filepath.Join(f.root, root), func(path string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(f.root, path)
+		return fn("/"+rel, info, err)
+	})
+}
+
+func (f fixtureFS) Command(_ context.Context, name string, arg ...string) ([]byte, error) {
+	cmd := strings.Join(append([]string{filepath.Base(name)}, arg...), " ")
+	return os.ReadFile(filepath.Join(f.root, "exec", cmd))
+}
+
+func fixtureDockers(context.Context) (map[string]apitypes.ContainerJSON, error) {
+	dat, err := os.ReadFile(filepath.Join(fixtureRoot, "docker.json"))
+	if err != nil {
+		return nil, err
+	}
+	dockers := make(map[string]apitypes.ContainerJSON)
+	err = json.Unmarshal(dat, &dockers)
+	return dockers, err
+}
+
+// newFixtureMetrics points everything at the fixture tree, with the host
+// root seen under /rootfs, and starts a scrape as the collectors which run
+// first would have left it.  The paths are put back when the test ends.
+func newFixtureMetrics(t *testing.T) *Metrics {
+	t.Helper()
+	proc, sys, rootfs, textfile := procPath, sysPath, rootfsPath, textfileDirectory
+	scripts, dockers := scriptFiles, listDockers
+	t.Cleanup(func() {
+		procPath, sysPath, rootfsPath, textfileDirectory = proc, sys, rootfs, textfile
+		scriptFiles, listDockers = scripts, dockers
+	})
+	procPath, sysPath, rootfsPath = "/proc", "/sys", "/rootfs"
+	textfileDirectory = "/textfile"
+	scriptFiles = nil
+	listDockers = fixtureDockers
+
+	// Docker labels and the service list are shared with the later collectors
+	m := &Metrics{FS: fixtureFS{fixtureRoot}}
+	prime := &Metrics{FS: m.FS, scrape: m.shared()}
+	if err := prime.CollectDocker(); err != nil {
+		t.Fatal(err)
+	}
+	prime.CollectMemory()
+	return m
+}
+
+// fixtureLoadavg runs just the loadavg collector on the fixture tree for the
+// rest of the test, for tests which need a collection of this host but not
+// any one collector.
+func fixtureLoadavg(t *testing.T) {
+	t.Helper()
+	saved, savedProc, savedFS := Collectors, procPath, hostFS
+	t.Cleanup(func() { Collectors, procPath, hostFS = saved, savedProc, savedFS })
+	Collectors = []*Collector{{Name: "loadavg", Enabled: true, Collect: (*Metrics).CollectLoadavg}}
+	procPath = "/proc"
+	hostFS = fixtureFS{fixtureRoot}
+}
+
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	golden := filepath.Join("testdata", "golden", name)
+	if *update {
+		if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s, run go test -update to see the change\n--- got:\n%s", golden, got)
+	}
+}
+
+// fixtureSkipped are the collectors a captured host has nothing for, which
+// are tested on their own.
+var fixtureSkipped = map[string]string{
+	"script": "runs real scripts and reports how long they took, see script_test.go",
+	"tunnel": "reports the tunnels of this process, see tunnel_test.go",
+}
+
+func TestCollectors(t *testing.T) {
+	for _, c := range Collectors {
+		t.Run(c.Name, func(t *testing.T) {
+			if why, ok := fixtureSkipped[c.Name]; ok {
+				t.Skip(why)
+			}
+			m := newFixtureMetrics(t)
+			if err := c.Collect(m); err != nil {
+				t.Errorf("%s: %v", c.Name, err)
+			}
+			checkGolden(t, c.Name+".prom", m.String())
+		})
+	}
+}
+
+func TestCollectorSuccess(t *testing.T) {
+	saved := Collectors
+	defer func() { Collectors = saved }()
+	Collectors = []*Collector{
+		{Name: "good", Enabled: true, Collect: func(*Metrics) error { return nil }},
+		{Name: "bad", Enabled: true, Collect: func(m *Metrics) error {
+			m.PrintType("node_half", "gauge", "Half a family")
+			m.PrintInt(nil, 1)
+			return errors.New("broken")
+		}},
+		{Name: "panics", Enabled: true, Collect: func(*Metrics) error { panic("broken") }},
+		{Name: "off", Enabled: false, Collect: func(*Metrics) error { return nil }},
+	}
+
+	m := newFixtureMetrics(t)
+	s, err := m.CollectAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`node_scrape_collector_success{collector="bad"} 0`,
+		`node_scrape_collector_success{collector="good"} 1`,
+		`node_scrape_collector_success{collector="panics"} 0`,
+		`node_scrape_collector_duration_seconds{collector="good"} `,
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("missing %q in:\n%s", want, s)
+		}
+	}
+	if strings.Contains(s, `collector="off"`) || strings.Contains(s, "node_half") {
+		t.Errorf("disabled collector or output of a failed one reported:\n%s", s)
+	}
+}
+
+// A chain of collectors waiting on each other gets no more time than the
+// slowest of them alone.
+func TestScrapeDeadline(t *testing.T) {
+	saved := Collectors
+	defer func() { Collectors = saved }()
+	release := make(chan struct{})
+	defer close(release)
+	hang := func(*Metrics) error { <-release; return nil }
+	Collectors = []*Collector{
+		{Name: "first", Enabled: true, Timeout: 100 * time.Millisecond, Collect: hang},
+		{Name: "second", Enabled: true, Timeout: 100 * time.Millisecond, After: []string{"first"}, Collect: hang},
+	}
+
+	m := newFixtureMetrics(t)
+	if _, err := m.CollectAll(); err == nil || !strings.Contains(err.Error(), "not started") {
+		t.Errorf("second collector: %v", err)
+	}
+}
+
+func TestCollectAllFailures(t *testing.T) {
+	fixtureLoadavg(t)
+	m := &Metrics{NoScrapeFamilies: true}
+	s, err := m.CollectAll()
+	if err != nil || !strings.Contains(s, "node_load1 0.42\n") || strings.Contains(s, "node_scrape_collector_") {
+		t.Errorf("collection without scrape families: %v\n%s", err, s)
+	}
+
+	// With every collector failing there is nothing worth showing
+	m = &Metrics{FS: missingFS{fixtureFS{fixtureRoot}, map[string]bool{"/proc/loadavg": true}}}
+	if _, err := m.CollectAll(); err == nil || !strings.Contains(err.Error(), "all 1 collectors failed") {
+		t.Errorf("collection with every collector failing: %v", err)
+	}
+}
+
+func TestCollectorTimeout(t *testing.T) {
+	saved := Collectors
+	defer func() { Collectors = saved }()
+	release := make(chan struct{})
+	defer close(release)
+	var order []string
+	Collectors = []*Collector{
+		{Name: "first", Enabled: true, Collect: func(m *Metrics) error {
+			time.Sleep(20 * time.Millisecond)
+			order = append(order, "first")
+			m.PrintType("node_test", "gauge", "Test")
+			m.PrintInt(Labels{"from": "first"}, 1)
+			return nil
+		}},
+		{Name: "hung", Enabled: true, Timeout: 50 * time.Millisecond, Collect: func(m *Metrics) error {
+			select {
+			case <-release:
+			case <-m.context().Done():
+				<-release
+			}
+			return nil
+		}},
+		{Name: "second", Enabled: true, After: []string{"first"}, Collect: func(m *Metrics) error {
+			order = append(order, "second")
+			m.PrintType("node_test", "gauge", "Test")
+			m.PrintInt(Labels{"from": "second"}, 2)
+			return nil
+		}},
+	}
+
+	m := newFixtureMetrics(t)
+	start := time.Now()
+	s, err := m.CollectAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("scrape took %v with a hung collector", d)
+	}
+	if strings.Join(order, ",") != "first,second" {
+		t.Errorf("collectors ran in order %v", order)
+	}
+	for _, want := range []string{
+		`node_scrape_collector_success{collector="hung"} 0`,
+		`node_scrape_collector_success{collector="second"} 1`,
+		"node_test{from=\"first\"} 1\nnode_test{from=\"second\"} 2\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("missing %q in:\n%s", want, s)
+		}
+	}
+}
+
+// missingFS is the fixture tree with some files and commands gone.
+type missingFS struct {
+	fixtureFS
+	missing map[string]bool
+}
+
+func (f missingFS) ReadFile(name string) ([]byte, error) {
+	if f.missing[name] {
+		return nil, os.ErrNotExist
+	}
+	return f.fixtureFS.ReadFile(name)
+}
+
+func (f missingFS) Command(ctx context.Context, name string, arg ...string) ([]byte, error) {
+	if f.missing[filepath.Base(name)] {
+		return nil, errors.New("executable file not found in $PATH")
+	}
+	return f.fixtureFS.Command(ctx, name, arg...)
+}
+
+func TestCollectorErrors(t *testing.T) {
+	for _, tc := range []struct {
+		collect func(*Metrics) error
+		missing string
+		fail    bool
+	}{
+		{(*Metrics).CollectKernel, "/rootfs/etc/system-release", false},
+		{(*Metrics).CollectKernel, "uname", true},
+		{(*Metrics).CollectFilesystem, "df", true},
+		{(*Metrics).CollectSystemd, "systemctl", true},
+	} {
+		m := newFixtureMetrics(t)
+		m.FS = missingFS{fixtureFS{fixtureRoot}, map[string]bool{tc.missing: true}}
+		if err := tc.collect(m); (err != nil) != tc.fail {
+			t.Errorf("without %s: error %v, want failure %v", tc.missing, err, tc.fail)
+		}
+	}
+}
+
+func TestCommandDockers(t *testing.T) {
+	m := newFixtureMetrics(t)
+	got, err := m.commandDockers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := fixtureDockers(context.Background())
+	if len(got) != len(want) {
+		t.Fatalf("got %d containers, want %d", len(got), len(want))
+	}
+	for id, d := range want {
+		if got[id].Name != d.Name || got[id].State.Pid != d.State.Pid {
+			t.Errorf("container %s = %s pid %d, want %s pid %d", id, got[id].Name, got[id].State.Pid, d.Name, d.State.Pid)
+		}
+	}
+}
+
+func TestUnescapeMount(t *testing.T) {
+	for in, want := range map[string]string{
+		"/srv/backup":              "/srv/backup",
+		`/srv/backup\040disk`:      "/srv/backup disk",
+		`/mnt/tab\011and\134slash`: "/mnt/tab\tand\\slash",
+		`/mnt/short\04`:            `/mnt/short\04`,
+		`/mnt/not\999octal`:        `/mnt/not\999octal`,
+	} {
+		if got := unescapeMount(in); got != want {
+			t.Errorf("unescapeMount(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Naming modes which can be selected with --compat.
+const (
+	CompatNone         = ""
+	CompatNodeExporter = "node_exporter"
+)
+
+// compatMode renames the families on output, set with --compat.
+var compatMode = CompatNone
+
+func validCompat(mode string) bool {
+	return mode == CompatNone || mode == CompatNodeExporter
+}
+
+// compatName is how a family is presented by upstream node_exporter.  The
+// values are multiplied by Scale to bring them to the base unit.
+type compatName struct {
+	Name  string
+	Type  string
+	Help  string
+	Scale float64
+}
+
+// nodeExporterNames maps the node-stats families onto the node_exporter
+// names, types and units the community dashboards and alerts expect.
+// Families which are not listed are either named the same upstream or have
+// no upstream counterpart, and are passed through as they are.
+var nodeExporterNames = map[string]compatName{
+	"node_boot_time":        {"node_boot_time_seconds", "gauge", "Node boot time, in unixtime", 1},
+	"node_context_switches": {"node_context_switches_total", "counter", "Total number of context switches", 1},
+	"node_cpu_seconds":      {"node_cpu_seconds_total", "counter", "Seconds the CPUs spent in each mode", 1},
+	"node_forks":            {"node_forks_total", "counter", "Total number of forks", 1},
+	"node_intr":             {"node_intr_total", "counter", "Total number of interrupts serviced", 1},
+	"node_time":             {"node_time_seconds", "gauge", "System time in seconds since epoch (1970)", 1},
+
+	"node_disk_reads_completed":  {"node_disk_reads_completed_total", "counter", "The total number of reads completed successfully", 1},
+	"node_disk_reads_merged":     {"node_disk_reads_merged_total", "counter", "The total number of reads merged", 1},
+	"node_disk_sectors_read":     {"node_disk_read_bytes_total", "counter", "The total number of bytes read successfully", 512},
+	"node_disk_read_time_ms":     {"node_disk_read_time_seconds_total", "counter", "The total number of seconds spent by all reads", 0.001},
+	"node_disk_writes_completed": {"node_disk_writes_completed_total", "counter", "The total number of writes completed successfully", 1},
+	"node_disk_writes_merged":    {"node_disk_writes_merged_total", "counter", "The number of writes merged", 1},
+	"node_disk_sectors_written":  {"node_disk_written_bytes_total", "counter", "The total number of bytes written successfully", 512},
+	"node_disk_write_time_ms":    {"node_disk_write_time_seconds_total", "counter", "This is the total number of seconds spent by all writes", 0.001},
+	"node_disk_io_now":           {"node_disk_io_now", "gauge", "The number of I/Os currently in progress", 1},
+	"node_disk_io_time_ms":       {"node_disk_io_time_seconds_total", "counter", "Total seconds spent doing I/Os", 0.001},
+	"node_disk_io_time_weighted": {"node_disk_io_time_weighted_seconds_total", "counter", "The weighted # of seconds spent doing I/Os", 0.001},
+
+	// df reports in 1K blocks
+	"node_filesystem_size":  {"node_filesystem_size_bytes", "gauge", "Filesystem size in bytes", 1024},
+	"node_filesystem_free":  {"node_filesystem_free_bytes", "gauge", "Filesystem free space in bytes", 1024},
+	"node_filesystem_avail": {"node_filesystem_avail_bytes", "gauge", "Filesystem space available to non-root users in bytes", 1024},
+
+	"node_systemd_unit_state":              {"node_systemd_unit_state", "gauge", "Systemd unit", 1},
+	"node_systemd_unit_start_time_seconds": {"node_systemd_unit_start_time_seconds", "gauge", "Systemd start time since boot", 1},
+}
+
+// nodeExporterGuest is where node_exporter keeps the time spent in guests,
+// which user and nice already include.
+var nodeExporterGuest = compatName{"node_cpu_guest_seconds_total", "counter", "Seconds the CPUs spent in guests (VMs) for each mode", 1}
+
+// nodeExporterSamples relabel the samples of a family as node_exporter labels
+// them, and name the family a sample belongs to when it is another.
+var nodeExporterSamples = map[string]func(Labels) (Labels, *compatName){
+	// cpu="0" rather than cpu="cpu0", with guest time apart so summing the
+	// modes does not count it twice
+	"node_cpu_seconds": func(l Labels) (Labels, *compatName) {
+		l = l.With(Labels{"cpu": strings.TrimPrefix(l["cpu"], "cpu")})
+		switch l["mode"] {
+		case "guest":
+			l["mode"] = "user"
+			return l, &nodeExporterGuest
+		case "guest_nice":
+			l["mode"] = "nice"
+			return l, &nodeExporterGuest
+		}
+		return l, nil
+	},
+	"node_systemd_unit_state":              compatUnitName,
+	"node_systemd_unit_start_time_seconds": compatUnitName,
+}
+
+// compatUnitName gives the unit the .service suffix of its full name.
+func compatUnitName(l Labels) (Labels, *compatName) {
+	if name, ok := l["name"]; ok && !strings.Contains(name, ".") {
+		l = l.With(Labels{"name": name + ".service"})
+	}
+	return l, nil
+}
+
+// compatFamily returns how the family is named in the selected mode.
+func compatFamily(f *Family) (compatName, bool) {
+	if compatMode != CompatNodeExporter {
+		return compatName{}, false
+	}
+	if c, ok := nodeExporterNames[f.Name]; ok {
+		return c, true
+	}
+	if strings.HasPrefix(f.Name, "node_network_receive_") || strings.HasPrefix(f.Name, "node_network_transmit_") {
+		stat := strings.TrimPrefix(f.Name, "node_network_")
+		return compatName{f.Name + "_total", "counter", "Network device statistic " + stat, 1}, true
+	}
+	return compatName{}, false
+}
+
+// applyCompat renames, retypes, rescales and relabels the families for the
+// selected naming mode and puts them back in name order.  The families given
+// are left untouched.
+func applyCompat(fams []*Family) []*Family {
+	if compatMode == CompatNone {
+		return fams
+	}
+	ret := make([]*Family, 0, len(fams))
+	moved := map[string]*Family{}
+	for _, f := range fams {
+		c, ok := compatFamily(f)
+		if !ok {
+			ret = append(ret, f)
+			continue
+		}
+		nf := &Family{Name: c.Name, Type: c.Type, Help: c.Help, Samples: make([]Sample, 0, len(f.Samples))}
+		ret = append(ret, nf)
+		relabel := nodeExporterSamples[f.Name]
+		for _, s := range f.Samples {
+			s.Value *= c.Scale
+			to := nf
+			if relabel != nil {
+				var other *compatName
+				if s.Labels, other = relabel(s.Labels); other != nil {
+					if to = moved[other.Name]; to == nil {
+						to = &Family{Name: other.Name, Type: other.Type, Help: other.Help}
+						moved[other.Name] = to
+						ret = append(ret, to)
+					}
+				}
+			}
+			to.Samples = append(to.Samples, s)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config lists the hosts served on /probe, from a file such as:
+//
+//	exporter:
+//	  - name: web1
+//	    host: 10.0.0.5
+//	    user: monitor
+//	    key: /etc/node-stats/id_ed25519
+//	    cert: /etc/node-stats/id_ed25519-cert.pub
+//	forward:
+//	  - host: bastion.example.com
+//	    user: monitor
+//	    local: 9101
+//	    remote: 10.1.0.7:9100
+type Config struct {
+	Exporter []Target  `yaml:"exporter"`
+	Forward  []Forward `yaml:"forward"`
+}
+
+// Target is a host collected from over SSH.  The name is what scrapers ask
+// for, and defaults to the host.  The passphrase decrypts the key, and the
+// script is a local file run on the host by the script collector.
+type Target struct {
+	Name       string `yaml:"name"`
+	Host       string `yaml:"host"`
+	Port       int    `yaml:"port"`
+	User       string `yaml:"user"`
+	Pass       string `yaml:"pass"`
+	Key        string `yaml:"key"`
+	Cert       string `yaml:"cert"`
+	Passphrase string `yaml:"passphrase"`
+	Script     string `yaml:"script"`
+}
+
+// Forward is a tunnel from a local address to a remote address reached
+// from the host.  A bare port listens on all addresses, and the name
+// defaults to the local address.
+type Forward struct {
+	Target `yaml:",inline"`
+	Local  string `yaml:"local"`
+	Remote string `yaml:"remote"`
+}
+
+// LoadConfig reads the config file, looking next to the executable when it
+// is not found as given.
+func LoadConfig(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) && !filepath.IsAbs(file) {
+		if exe, e := os.Executable(); e == nil {
+			if d, e := os.ReadFile(filepath.Join(filepath.Dir(exe), filepath.Base(file))); e == nil {
+				data, err = d, nil
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for i := range config.Exporter {
+		t := &config.Exporter[i]
+		if t.Host == "" {
+			return nil, fmt.Errorf("%s: exporter %d has no host", file, i+1)
+		}
+		if t.Name == "" {
+			t.Name = t.Host
+		}
+		if t.Port == 0 {
+			t.Port = 22
+		}
+	}
+	for i := range config.Forward {
+		f := &config.Forward[i]
+		switch {
+		case f.Host == "":
+			return nil, fmt.Errorf("%s: forward %d has no host", file, i+1)
+		case f.Local == "":
+			return nil, fmt.Errorf("%s: forward %d has no local address", file, i+1)
+		case f.Remote == "":
+			return nil, fmt.Errorf("%s: forward %d has no remote address", file, i+1)
+		}
+		if f.Name == "" {
+			f.Name = f.Local
+		}
+	}
+	return config, nil
+}
+
+// Clients sets up a client for each target, keyed by the target name.  No
+// connection is made until a target is probed, and a client is kept open
+// between probes.
+func (c *Config) Clients() (map[string]*Client, error) {
+	clients := make(map[string]*Client, len(c.Exporter))
+	for _, t := range c.Exporter {
+		if _, ok := clients[t.Name]; ok {
+			return nil, fmt.Errorf("target %q is listed twice", t.Name)
+		}
+		client, err := NewClient(t)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %v", t.Name, err)
+		}
+		clients[t.Name] = client
+	}
+	return clients, nil
+}
+
+// Tunnels sets up the tunnel of each forward entry, ready to be started.
+func (c *Config) Tunnels() ([]*Tunnel, error) {
+	var tunnels []*Tunnel
+	names := make(map[string]bool)
+	for _, f := range c.Forward {
+		if names[f.Name] {
+			return nil, fmt.Errorf("forward %q is listed twice", f.Name)
+		}
+		names[f.Name] = true
+		t, err := NewTunnel(f)
+		if err != nil {
+			return nil, fmt.Errorf("forward %q: %v", f.Name, err)
+		}
+		tunnels = append(tunnels, t)
+	}
+	return tunnels, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, s string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "node-stats.yml")
+	if err := os.WriteFile(file, []byte(s), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `
+exporter:
+  - host: 10.0.0.5
+    user: monitor
+  - name: db
+    host: db.example.com
+    port: 2222
+    pass: secret
+forward:
+  - host: bastion
+    local: 9101
+    remote: 10.1.0.7:9100
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients, err := config.Clients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := clients["10.0.0.5"]; c == nil || c.Addr != "10.0.0.5:22" || c.Config.User != "monitor" {
+		t.Errorf("unnamed target = %+v", c)
+	}
+	if c := clients["db"]; c == nil || c.Addr != "db.example.com:2222" {
+		t.Errorf("named target = %+v", c)
+	}
+	tunnels, err := config.Tunnels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 1 || tunnels[0].Name != "9101" || tunnels[0].Local != ":9101" || tunnels[0].client.Addr != "bastion:22" {
+		t.Errorf("tunnels = %+v", tunnels)
+	}
+
+	for _, tc := range []struct{ config, err string }{
+		{"exporter:\n  - user: monitor\n", "exporter 1 has no host"},
+		{"exporter:\n  - host: a\n  - name: a\n    host: b\n", `target "a" is listed twice`},
+		{"exporter:\n  - host: a\n    key: /nonexistent\n", "unable to read private key"},
+		{"exporter: [\n", "yaml"},
+		{"forward:\n  - host: a\n    local: 9101\n", "forward 1 has no remote address"},
+		{"forward:\n  - {host: a, local: 1, remote: b:1}\n  - {host: b, local: 1, remote: b:2}\n", `forward "1" is listed twice`},
+	} {
+		config, err := LoadConfig(writeConfig(t, tc.config))
+		if err == nil {
+			_, err = config.Clients()
+		}
+		if err == nil {
+			_, err = config.Tunnels()
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: error %v, want %q", tc.config, err, tc.err)
+		}
+	}
+}
+
+func TestProbeTarget(t *testing.T) {
+	h := probeHandler(FormatPrometheus, false, map[string]*Client{})
+	for target, code := range map[string]int{"": http.StatusBadRequest, "nope": http.StatusNotFound} {
+		rw := httptest.NewRecorder()
+		h(rw, httptest.NewRequest("GET", "/probe?target="+target, nil))
+		if rw.Code != code {
+			t.Errorf("target %q: status %d, want %d", target, rw.Code, code)
+		}
+	}
+}
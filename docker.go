@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"strings"
 	"time"
 
+	"github.com/araddon/dateparse"
 	apitypes "github.com/docker/docker/api/types"
 	containertypes "github.com/docker/docker/api/types/container"
 	dockerclient "github.com/docker/docker/client"
@@ -53,27 +55,141 @@ func Docker_sock(req string) string {
 	return ""
 }
 
-var Dockers = make(map[string]apitypes.ContainerJSON)
+// listDockers fetches the containers, replaced in the tests.
+var listDockers = getDocker
 
-func getDocker() []apitypes.Container {
-	ctx := context.Background()
+// CollectDocker looks up the running containers, records their labels for the
+// other collectors and reports the container state.
+func (m *Metrics) CollectDocker() error {
+	var dockers map[string]apitypes.ContainerJSON
+	var err error
+	if m.Client != nil {
+		dockers, err = m.commandDockers()
+	} else {
+		dockers, err = listDockers(m.context())
+	}
+	if err != nil {
+		return err
+	}
+	m.setDockers(dockers)
+
+	m.PrintType("node_docker_started_at", "gauge", "Docker created time")
+	for _, d := range m.sortedDockers() {
+		if strings.HasPrefix(d.State.StartedAt, "000") {
+			continue
+		}
+		if t, err := dateparse.ParseAny(d.State.StartedAt); err == nil {
+			m.PrintInt(m.dockerLabels(d.ID), t.UnixNano()/1e6)
+		} else {
+			//m.PrintStr(m.dockerLabels(d.ID), "NaN")
+		}
+	}
+
+	m.PrintType("node_docker_finished_at", "gauge", "Docker finished time")
+	for _, d := range m.sortedDockers() {
+		if strings.HasPrefix(d.State.FinishedAt, "000") {
+			continue
+		}
+		if t, err := dateparse.ParseAny(d.State.FinishedAt); err == nil {
+			m.PrintInt(m.dockerLabels(d.ID), t.UnixNano()/1e6)
+		} else {
+			//m.PrintStr(m.dockerLabels(d.ID), "NaN")
+		}
+	}
+
+	m.PrintType("node_docker_info", "gauge", "Docker info")
+	for _, d := range m.sortedDockers() {
+		/*
+			lblarr := make(map[string]string)
+			for l, v := range d.Labels {
+				lblarr[strings.ToLower(l)] = v
+			}
+			lblstr := []string{m.dockerLabels(d.ID)}
+			reg, _ := regexp.Compile("[^a-zA-Z0-9_]+")
+			for l, v := range lblarr {
+				lblstr = append(lblstr, fmt.Sprintf("%s=%q", reg.ReplaceAllString(l, "_"), v))
+			}
+			m.PrintInt(strings.Join(lblstr, ","), 1)
+		*/
+		m.PrintInt(m.dockerLabels(d.ID).With(Labels{"processLabel": d.ProcessLabel, "mountLabel": d.MountLabel}), 1)
+	}
+
+	m.PrintType("node_docker_running", "gauge", "Docker container is running")
+	for _, d := range m.sortedDockers() {
+		m.PrintBool(m.dockerLabels(d.ID), d.State.Running)
+	}
+	m.PrintType("node_docker_restarting", "gauge", "Docker container is running")
+	for _, d := range m.sortedDockers() {
+		m.PrintBool(m.dockerLabels(d.ID), d.State.Restarting)
+	}
+	m.PrintType("node_docker_restart_count", "gauge", "Docker restart count")
+	for _, d := range m.sortedDockers() {
+		m.PrintInt(m.dockerLabels(d.ID), int64(d.RestartCount))
+	}
+	m.PrintType("node_docker_size_rw", "gauge", "Docker container size RW")
+	for _, d := range m.sortedDockers() {
+		if d.SizeRw != nil {
+			m.PrintInt(m.dockerLabels(d.ID), *d.SizeRw)
+		}
+	}
+	m.PrintType("node_docker_size_root", "gauge", "Docker container size Root")
+	for _, d := range m.sortedDockers() {
+		if d.SizeRootFs != nil {
+			m.PrintInt(m.dockerLabels(d.ID), *d.SizeRootFs)
+		}
+	}
+
+	return nil
+}
+
+// commandDockers asks the docker command for the containers, which is how they
+// are found on a remote host where the API socket cannot be reached.
+func (m *Metrics) commandDockers() (map[string]apitypes.ContainerJSON, error) {
+	out, err := m.Command("docker", "ps", "-q", "--no-trunc")
+	if err != nil {
+		return nil, err
+	}
+	dockers := make(map[string]apitypes.ContainerJSON)
+	ids := strings.Fields(string(out))
+	if len(ids) == 0 {
+		return dockers, nil
+	}
+
+	out, err = m.Command("docker", append([]string{"inspect"}, ids...)...)
+	if err != nil {
+		return nil, err
+	}
+	var list []apitypes.ContainerJSON
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, err
+	}
+	for _, d := range list {
+		if d.ContainerJSONBase != nil {
+			dockers[d.ID] = d
+		}
+	}
+	return dockers, nil
+}
+
+func getDocker(ctx context.Context) (map[string]apitypes.ContainerJSON, error) {
 	cli, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer cli.Close()
 
 	containers, err := cli.ContainerList(ctx, containertypes.ListOptions{})
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
+	dockers := make(map[string]apitypes.ContainerJSON)
 	for _, c := range containers {
 		cj, err := cli.ContainerInspect(ctx, c.ID)
 		//fmt.Printf("Container:%#v\n", c)
 		//fmt.Printf("Container details:%#v\n", cj.ContainerJSONBase)
 		if err == nil {
-			Dockers[c.ID] = cj
+			dockers[c.ID] = cj
 		}
 	}
 
@@ -92,7 +208,7 @@ func getDocker() []apitypes.Container {
 			dockers[i].cont = cont
 			//fmt.Println("stats: ", Docker_sock(fmt.Sprintf("/v1.19/containers/%s/stats?stream=0", d.Id)))
 		}*/
-	return containers
+	return dockers, nil
 }
 
 /*type Docker struct {
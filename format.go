@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Exposition formats which can be selected with --format or negotiated over
+// HTTP.
+const (
+	FormatPrometheus  = "prometheus"
+	FormatOpenMetrics = "openmetrics"
+)
+
+var contentTypes = map[string]string{
+	FormatPrometheus:  "text/plain; version=0.0.4; charset=utf-8",
+	FormatOpenMetrics: "application/openmetrics-text; version=1.0.0; charset=utf-8",
+}
+
+// openMetricsUnits are the base units a family name may end in.  When it does
+// the unit is announced with a # UNIT line.
+var openMetricsUnits = []string{
+	"seconds", "bytes", "bits", "ratio", "celsius", "volts", "amperes", "joules", "grams", "meters",
+}
+
+func validFormat(format string) bool {
+	_, ok := contentTypes[format]
+	return ok
+}
+
+// negotiateFormat picks the exposition format from an HTTP Accept header:
+// OpenMetrics, delimited protobuf or Prometheus text when the scraper asks for
+// them, by preference, and otherwise def.
+func negotiateFormat(accept, def string) string {
+	format, best := def, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		value, params, q := acceptItem(part)
+		var f string
+		switch value {
+		case "application/openmetrics-text":
+			f = FormatOpenMetrics
+		case "application/vnd.google.protobuf":
+			if params["proto"] != protobufMessage || params["encoding"] != "delimited" {
+				continue
+			}
+			f = FormatProtobuf
+		case "text/plain":
+			f = FormatPrometheus
+		default:
+			continue
+		}
+		if q > best {
+			format, best = f, q
+		}
+	}
+	return format
+}
+
+// acceptItem splits one item of an Accept or Accept-Encoding header into
+// its value, its parameters and its q-value, which is 1 when not given.
+func acceptItem(item string) (string, map[string]string, float64) {
+	fields := strings.Split(item, ";")
+	params := map[string]string{}
+	for _, field := range fields[1:] {
+		k, v, _ := strings.Cut(field, "=")
+		params[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+	}
+	q := 1.0
+	if v, ok := params["q"]; ok {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			q = f
+		}
+	}
+	return strings.TrimSpace(fields[0]), params, q
+}
+
+// metricUnit returns the unit suffix of a family name, if it has a known one.
+func metricUnit(name string) string {
+	for _, unit := range openMetricsUnits {
+		if strings.HasSuffix(name, "_"+unit) {
+			return unit
+		}
+	}
+	return ""
+}
+
+// formatValue writes whole numbers without an exponent so counters stay
+// readable, everything else in the shortest form that round trips.
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case v == math.Trunc(v) && math.Abs(v) < 1e15:
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelValueEscaper escapes a label value as the exposition formats require.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// helpEscaper escapes a help text in the Prometheus text format, where quotes
+// are left as they are.  OpenMetrics escapes them as in label values.
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// labelName turns any string into a valid label name by replacing the
+// characters which are not allowed with an underscore.
+func labelName(s string) string {
+	if s == "" {
+		return "_"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// formatLabels is the one place label sets are turned into text, so every
+// name and value is escaped the same way whatever collector produced it.
+func formatLabels(l Labels) string {
+	if len(l) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(l))
+	for _, k := range l.Names() {
+		parts = append(parts, labelName(k)+`="`+labelValueEscaper.Replace(l[k])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// WriteText writes the families in the Prometheus text or OpenMetrics
+// exposition format.
+func WriteText(w io.Writer, format string, fams []*Family) error {
+	bw := bufio.NewWriter(w)
+	openMetrics := format == FormatOpenMetrics
+	for _, f := range fams {
+		name, sample := f.Name, f.Name
+		if openMetrics && f.Type == "counter" {
+			// OpenMetrics names the counter family without the _total the
+			// samples carry
+			name = strings.TrimSuffix(f.Name, "_total")
+			sample = name + "_total"
+		}
+		if f.Help != "" {
+			escaper := helpEscaper
+			if openMetrics {
+				escaper = labelValueEscaper
+			}
+			fmt.Fprintf(bw, "# HELP %s %s.\n", name, escaper.Replace(f.Help))
+		}
+		typ := f.Type
+		if openMetrics && typ == "untyped" {
+			typ = "unknown"
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, typ)
+		if unit := metricUnit(name); unit != "" && openMetrics {
+			fmt.Fprintf(bw, "# UNIT %s %s\n", name, unit)
+		}
+		for _, s := range f.Samples {
+			sampleName := sample
+			if s.Name != "" {
+				sampleName = s.Name
+			}
+			fmt.Fprintf(bw, "%s%s %s", sampleName, formatLabels(s.Labels), formatValue(s.Value))
+			if s.Timestamp != 0 {
+				if openMetrics {
+					fmt.Fprintf(bw, " %d.%03d", s.Timestamp/1000, s.Timestamp%1000)
+				} else {
+					fmt.Fprintf(bw, " %d", s.Timestamp)
+				}
+			}
+			bw.WriteString("\n")
+		}
+	}
+	if openMetrics {
+		bw.WriteString("# EOF\n")
+	}
+	return bw.Flush()
+}
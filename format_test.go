@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	for _, tc := range []struct {
+		accept, def, want string
+	}{
+		{"", FormatPrometheus, FormatPrometheus},
+		{"text/plain;version=0.0.4;q=0.5,*/*;q=0.1", FormatPrometheus, FormatPrometheus},
+		{"application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5", FormatPrometheus, FormatOpenMetrics},
+		{"text/plain", FormatOpenMetrics, FormatPrometheus},
+		{"*/*", FormatOpenMetrics, FormatOpenMetrics},
+		{"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3", FormatPrometheus, FormatProtobuf},
+		{"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=text", FormatPrometheus, FormatPrometheus},
+		{"application/openmetrics-text;q=0.5,application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.6", FormatPrometheus, FormatProtobuf},
+		{"text/plain;q=0.9,application/openmetrics-text;q=0.5", FormatPrometheus, FormatPrometheus},
+	} {
+		if got := negotiateFormat(tc.accept, tc.def); got != tc.want {
+			t.Errorf("negotiateFormat(%q, %q) = %q, want %q", tc.accept, tc.def, got, tc.want)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"deflate, gzip;q=0.5": true,
+		"gzip;q=0":            false,
+		"gzip; q=0.0, br":     false,
+		"*":                   true,
+		"*;q=0.1, gzip;q=0":   false,
+		"identity, *;q=0":     false,
+		"deflate, x-gzip;q=1": true,
+	} {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestMetricUnit(t *testing.T) {
+	for name, want := range map[string]string{
+		"node_cpu_seconds":            "seconds",
+		"node_memory_MemTotal_bytes":  "bytes",
+		"node_entropy_available_bits": "bits",
+		"node_filesystem_size":        "",
+		"node_load1":                  "",
+	} {
+		if got := metricUnit(name); got != want {
+			t.Errorf("metricUnit(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestOpenMetrics(t *testing.T) {
+	m := newFixtureMetrics(t)
+	m.Format = FormatOpenMetrics
+	m.Timestamp = 1792300583213
+
+	m.CollectStat()
+	m.CollectEntropy()
+	checkGolden(t, "stat.om", m.String())
+}
+
+func TestWriteTextHelp(t *testing.T) {
+	fams := []*Family{{Name: "node_quoted", Type: "gauge", Help: `A "quoted" C:\path` + "\nhelp"}}
+	for format, want := range map[string]string{
+		FormatPrometheus:  `# HELP node_quoted A "quoted" C:\\path\nhelp.`,
+		FormatOpenMetrics: `# HELP node_quoted A \"quoted\" C:\\path\nhelp.`,
+	} {
+		var b strings.Builder
+		WriteText(&b, format, fams)
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("%s help:\n%s", format, b.String())
+		}
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	for _, tc := range []struct {
+		labels Labels
+		want   string
+	}{
+		{nil, ""},
+		{Labels{"device": "eth0"}, `{device="eth0"}`},
+		{Labels{"mountpoint": `/mnt/a "b"`}, `{mountpoint="/mnt/a \"b\""}`},
+		{Labels{"comment": `C:\tmp` + "\nx"}, `{comment="C:\\tmp\nx"}`},
+		{Labels{"io.k8s/name": "x", "1st": "y"}, `{_st="y",io_k8s_name="x"}`},
+	} {
+		if got := formatLabels(tc.labels); got != tc.want {
+			t.Errorf("formatLabels(%q) = %s, want %s", tc.labels, got, tc.want)
+		}
+	}
+}
+
+func TestCompatNodeExporter(t *testing.T) {
+	m := newFixtureMetrics(t)
+	compatMode = CompatNodeExporter
+	defer func() { compatMode = CompatNone }()
+
+	m.CollectLoadavg()
+	m.CollectStat()
+	m.CollectDiskstats()
+	m.CollectFilesystem()
+	m.CollectNetdev(0, nil)
+	m.CollectSystemd()
+	checkGolden(t, "compat.prom", m.String())
+}
+
+func TestInflux(t *testing.T) {
+	m := newFixtureMetrics(t)
+	m.Format = FormatInflux
+	m.Timestamp = 1792300583213
+
+	m.CollectStat()
+	m.CollectEntropy()
+	checkGolden(t, "stat.influx", m.String())
+}
+
+func TestWriteInflux(t *testing.T) {
+	fams := []*Family{
+		{Name: "docker_restarts", Type: "counter", Samples: []Sample{
+			{Labels: Labels{"docker_name": "web 1", "docker_image": "nginx:1.27", "empty": ""}, Value: 3},
+			{Labels: Labels{"docker_name": "a,b=c"}, Value: math.NaN()},
+		}},
+		{Name: "node_latency_seconds", Type: "histogram", Samples: []Sample{
+			{Name: "node_latency_seconds_bucket", Labels: Labels{"le": "+Inf"}, Value: 2},
+			{Name: "node_latency_seconds_sum", Value: 0.25, Timestamp: 1000},
+		}},
+	}
+	var b strings.Builder
+	WriteInflux(&b, fams, time.Unix(2, 0))
+	want := `docker_restarts,docker_image=nginx:1.27,docker_name=web\ 1 value=3 2000000000
+node_latency_seconds,le=+Inf bucket=2 2000000000
+node_latency_seconds sum=0.25 1000000000
+`
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestGraphite(t *testing.T) {
+	m := newFixtureMetrics(t)
+	m.Format = FormatGraphite
+	m.Timestamp = 1792300583213
+	saved := graphiteTemplates
+	defer func() { graphiteTemplates = saved }()
+	graphiteTemplates = []graphiteTemplate{{Match: "node_cpu_*", Template: "node.cpu.{cpu}.{mode}"}}
+
+	m.CollectStat()
+	m.CollectEntropy()
+	m.Client = &Client{Addr: "web1:22"} // the host of the paths
+	checkGolden(t, "stat.graphite", m.String())
+}
+
+func TestWriteJSON(t *testing.T) {
+	fams := []*Family{
+		{Name: "node_load1", Type: "gauge", Help: "1m load average", Samples: []Sample{{Value: 0.5}}},
+		{Name: "node_latency_seconds", Type: "histogram", Samples: []Sample{
+			{Name: "node_latency_seconds_bucket", Labels: Labels{"le": "+Inf"}, Value: 2, Timestamp: 1000},
+			{Name: "node_latency_seconds_sum", Value: math.NaN(), Timestamp: 1000},
+		}},
+	}
+	var b strings.Builder
+	WriteJSON(&b, fams, time.Unix(2, 0), false)
+	want := `{"timestamp":2000,"families":{"node_latency_seconds":{"type":"histogram","unit":"seconds","samples":[` +
+		`{"name":"node_latency_seconds_bucket","labels":{"le":"+Inf"},"value":2,"timestamp":1000},` +
+		`{"name":"node_latency_seconds_sum","labels":{},"value":"NaN","timestamp":1000}]},` +
+		`"node_load1":{"type":"gauge","help":"1m load average","samples":[{"labels":{},"value":0.5}]}}}` + "\n"
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+
+	b.Reset()
+	WriteJSON(&b, fams, time.Unix(2, 0), true)
+	if strings.Count(b.String(), "\n") < 10 || !strings.HasPrefix(b.String(), "{\n  \"timestamp\": 2000,") {
+		t.Errorf("indented:\n%s", b.String())
+	}
+}
+
+func TestWriteProtobuf(t *testing.T) {
+	fams := []*Family{
+		{Name: "node_forks_total", Type: "counter", Help: "Forks", Samples: []Sample{{Labels: Labels{"docker_name": "/web"}, Value: 0, Timestamp: 1000}}},
+		{Name: "node_latency_seconds", Type: "histogram", Samples: []Sample{
+			{Name: "node_latency_seconds_bucket", Labels: Labels{"le": "0.5"}, Value: 1},
+			{Name: "node_latency_seconds_bucket", Labels: Labels{"le": "+Inf"}, Value: 3},
+			{Name: "node_latency_seconds_sum", Value: 2.5},
+			{Name: "node_latency_seconds_count", Value: 3},
+		}},
+	}
+	var b bytes.Buffer
+	WriteProtobuf(&b, fams)
+
+	var msgs []map[int][]interface{}
+	for data := b.Bytes(); len(data) > 0; {
+		l, n := binary.Uvarint(data)
+		msgs = append(msgs, protoFields(t, data[n:n+int(l)]))
+		data = data[n+int(l):]
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("%d messages, want 2", len(msgs))
+	}
+
+	counter := msgs[0]
+	metric := protoFields(t, counter[4][0].([]byte))
+	label := protoFields(t, metric[1][0].([]byte))
+	if string(counter[1][0].([]byte)) != "node_forks_total" || counter[3] != nil || metric[3] == nil || metric[6][0].(uint64) != 1000 ||
+		string(label[1][0].([]byte)) != "docker_name" || string(label[2][0].([]byte)) != "/web" {
+		t.Errorf("counter %v, metric %v", counter, metric)
+	}
+
+	hist := msgs[1]
+	h := protoFields(t, protoFields(t, hist[4][0].([]byte))[7][0].([]byte))
+	if hist[3][0].(uint64) != 4 || string(hist[5][0].([]byte)) != "seconds" || h[1][0].(uint64) != 3 || h[2][0].(float64) != 2.5 || len(h[3]) != 1 {
+		t.Fatalf("histogram %v, %v", hist, h)
+	}
+	if bucket := protoFields(t, h[3][0].([]byte)); bucket[1][0].(uint64) != 1 || bucket[2][0].(float64) != 0.5 {
+		t.Errorf("bucket %v", bucket)
+	}
+}
+
+func TestServeProtobuf(t *testing.T) {
+	fixtureLoadavg(t)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3")
+	metricsHandler(FormatPrometheus, false, nil)(rw, req)
+	if ct := rw.Header().Get("Content-Type"); ct != contentTypes[FormatProtobuf] {
+		t.Errorf("content type %q", ct)
+	}
+	l, n := binary.Uvarint(rw.Body.Bytes())
+	if n <= 0 || int(l) > rw.Body.Len()-n || !bytes.Contains(rw.Body.Bytes(), []byte("node_load1")) {
+		t.Errorf("body %q", rw.Body.Bytes())
+	}
+}
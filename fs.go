@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// FS is everything the collectors read from the system: files, directory
+// trees and the output of commands.  The local host is used unless the
+// Metrics are given another one, which is how the tests replay samples.
+// Commands are killed when the context is done.
+type FS interface {
+	ReadFile(name string) ([]byte, error)
+	ReadDir(name string) ([]string, error)
+	ModTime(name string) (time.Time, error)
+	Walk(root string, fn filepath.WalkFunc) error
+	Command(ctx context.Context, name string, arg ...string) ([]byte, error)
+}
+
+// contextFS is an FS whose reads take time enough to need giving up, bound
+// to the context of the collector reading.
+type contextFS interface {
+	withContext(ctx context.Context) FS
+}
+
+// LocalFS reads straight from the host the collector is running on.
+type LocalFS struct{}
+
+// hostFS is read when collecting from this host.  The tests point it at a
+// fixture tree.
+var hostFS FS = LocalFS{}
+
+func (LocalFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (LocalFS) ReadDir(name string) ([]string, error) {
+	d, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(0)
+}
+
+func (LocalFS) ModTime(name string) (time.Time, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+func (LocalFS) Walk(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, fn)
+}
+
+// Command kills the command when the context is done, and gives up on its
+// output soon after should a child of it still hold the pipe.
+func (LocalFS) Command(ctx context.Context, name string, arg ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, arg...)
+	cmd.WaitDelay = time.Second
+	return cmd.Output()
+}
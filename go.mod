@@ -1,12 +1,16 @@
-module main
+// The module is not named main, as go test cannot build the tests of a
+// module whose import path is "main".
+module github.com/pschou/node-stats
 
 go 1.22.1
 
 require (
 	github.com/araddon/dateparse v0.0.0-20210429162001-6b43995a97de
 	github.com/docker/docker v27.0.3+incompatible
+	github.com/golang/snappy v0.0.4
 	github.com/pschou/go-params v0.0.0-20240104134853-225c817afb69
 	golang.org/x/crypto v0.25.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
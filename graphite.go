@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FormatGraphite is the Graphite plaintext protocol, as Carbon accepts.
+const FormatGraphite = "graphite"
+
+func init() {
+	contentTypes[FormatGraphite] = "text/plain; charset=utf-8"
+}
+
+// graphiteTemplate lays out the path of the families matching a glob, such
+// as node_cpu_seconds_total=node.{host}.cpu.{cpu}.{mode}.  Between braces go
+// label names, {name} for the metric name and {host} for the host collected
+// from, unless the sample has a host label of its own.  A label the sample
+// lacks is written as an underscore.
+type graphiteTemplate struct {
+	Match    string
+	Template string
+}
+
+// graphiteTemplates are tried in turn, the first matching a family is used.
+// Families none match are written as the host, the metric name and then the
+// name and value of each label, so the hosts sending to one Carbon do not
+// overwrite each other.
+var graphiteTemplates []graphiteTemplate
+
+// parseGraphiteTemplate reads a FAMILY=TEMPLATE flag value.
+func parseGraphiteTemplate(s string) (graphiteTemplate, error) {
+	match, tmpl, ok := strings.Cut(s, "=")
+	if !ok || match == "" || tmpl == "" {
+		return graphiteTemplate{}, fmt.Errorf("expected FAMILY=TEMPLATE, got %q", s)
+	}
+	if _, err := path.Match(match, ""); err != nil {
+		return graphiteTemplate{}, fmt.Errorf("bad family pattern %q: %v", match, err)
+	}
+	if strings.Count(tmpl, "{") != strings.Count(tmpl, "}") {
+		return graphiteTemplate{}, fmt.Errorf("unbalanced braces in template %q", tmpl)
+	}
+	return graphiteTemplate{Match: match, Template: tmpl}, nil
+}
+
+// graphiteComponent makes a path component of any string, replacing the
+// dots, spaces and other characters Graphite treats specially with an
+// underscore.
+func graphiteComponent(s string) string {
+	if s == "" {
+		return "_"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c == '_', c == '-', c == ':', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// graphitePath is the dotted path of a sample.  Labels the template does not
+// place are added at the end as name and value, so no two series share a
+// path.
+func graphitePath(name string, labels Labels, host string, templates []graphiteTemplate) string {
+	var tmpl string
+	for _, t := range templates {
+		if ok, _ := path.Match(t.Match, name); ok {
+			tmpl = t.Template
+			break
+		}
+	}
+	if tmpl == "" {
+		tmpl = "{host}.{name}"
+	}
+
+	used := map[string]bool{}
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(tmpl, '{')
+		end := strings.IndexByte(tmpl, '}')
+		if start < 0 || end < start {
+			b.WriteString(tmpl)
+			break
+		}
+		b.WriteString(tmpl[:start])
+		key := tmpl[start+1 : end]
+		tmpl = tmpl[end+1:]
+		used[key] = true
+		switch v, ok := labels[key]; {
+		case ok:
+			b.WriteString(graphiteComponent(v))
+		case key == "name":
+			b.WriteString(graphiteComponent(name))
+		case key == "host":
+			b.WriteString(graphiteComponent(host))
+		default:
+			b.WriteString("_")
+		}
+	}
+	for _, k := range labels.Names() {
+		if !used[k] {
+			b.WriteString("." + graphiteComponent(k) + "." + graphiteComponent(labels[k]))
+		}
+	}
+	return b.String()
+}
+
+// WriteGraphite writes the families in the Graphite plaintext protocol,
+// stamped in seconds with the time of the sample or else now.  NaN and the
+// infinities, which Graphite cannot store, are left out.
+func WriteGraphite(w io.Writer, fams []*Family, host string, templates []graphiteTemplate, now time.Time) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range fams {
+		for _, s := range f.Samples {
+			if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+				continue
+			}
+			name := f.Name
+			if s.Name != "" {
+				name = s.Name
+			}
+			ts := now.Unix()
+			if s.Timestamp != 0 {
+				ts = s.Timestamp / 1000
+			}
+			bw.WriteString(graphitePath(name, s.Labels, host, templates) + " " + formatValue(s.Value) + " " + strconv.FormatInt(ts, 10) + "\n")
+		}
+	}
+	return bw.Flush()
+}
+
+// host is the name of the host collected from, for the {host} of Graphite
+// templates.
+func (m *Metrics) host() string {
+	if m.Client != nil {
+		if host, _, err := net.SplitHostPort(m.Client.Addr); err == nil {
+			return host
+		}
+		return m.Client.Addr
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// Carbon sends the metrics to a Carbon plaintext listener on an interval,
+// for hosts graphed with Graphite.
+type Carbon struct {
+	Addr     string
+	Interval time.Duration
+	Client   *Client
+}
+
+// Run sends on every tick of the interval and does not return.  Failed sends
+// are logged and the next tick sends fresh metrics.
+func (c *Carbon) Run() {
+	log.Printf("Sending to carbon at %s every %v\n", c.Addr, c.Interval)
+	for range tick(c.Interval) {
+		if err := c.Send(); err != nil {
+			log.Printf("carbon %s: %v\n", c.Addr, err)
+		}
+	}
+}
+
+// Send collects once and writes the result on a new connection.
+func (c *Carbon) Send() error {
+	m := Metrics{Client: c.Client, Format: FormatGraphite}
+	body, err := m.CollectAll()
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", c.Addr, c.Interval)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Interval))
+	if _, err := io.WriteString(conn, body); err != nil {
+		return err
+	}
+	return conn.Close()
+}
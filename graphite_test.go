@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGraphitePath(t *testing.T) {
+	templates := []graphiteTemplate{
+		{Match: "node_cpu_seconds_total", Template: "node.{host}.cpu.{cpu}.{mode}"},
+		{Match: "node_disk_*", Template: "{host}.disk.{device}.{name}"},
+	}
+	for _, tc := range []struct {
+		name   string
+		labels Labels
+		want   string
+	}{
+		{"node_cpu_seconds_total", Labels{"cpu": "0", "mode": "idle"}, "node.web1.cpu.0.idle"},
+		{"node_cpu_seconds_total", Labels{"cpu": "0", "mode": "idle", "host": "db.example.com"}, "node.db_example_com.cpu.0.idle"},
+		{"node_cpu_seconds_total", Labels{"cpu": "0"}, "node.web1.cpu.0._"},
+		{"node_disk_read_bytes_total", Labels{"device": "sda", "major": "8"}, "web1.disk.sda.node_disk_read_bytes_total.major.8"},
+		{"node_filesystem_avail_bytes", Labels{"mountpoint": "/var/lib", "fstype": "ext4"}, "web1.node_filesystem_avail_bytes.fstype.ext4.mountpoint._var_lib"},
+		{"node_load1", nil, "web1.node_load1"},
+		{"node_load1", Labels{"host": "db"}, "db.node_load1"},
+	} {
+		if got := graphitePath(tc.name, tc.labels, "web1", templates); got != tc.want {
+			t.Errorf("graphitePath(%s, %q) = %s, want %s", tc.name, tc.labels, got, tc.want)
+		}
+	}
+
+	for _, s := range []string{"node_cpu", "=a", "node_[=a", "node_cpu={cpu"} {
+		if _, err := parseGraphiteTemplate(s); err == nil {
+			t.Errorf("parseGraphiteTemplate(%q) did not fail", s)
+		}
+	}
+}
+
+func TestCarbon(t *testing.T) {
+	fixtureLoadavg(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		b, _ := io.ReadAll(conn)
+		conn.Close()
+		received <- string(b)
+	}()
+
+	c := &Carbon{Addr: ln.Addr().String(), Interval: 5 * time.Second}
+	if err := c.Send(); err != nil {
+		t.Fatal(err)
+	}
+	body := <-received
+	host := graphiteComponent((&Metrics{}).host())
+	if !strings.HasPrefix(body, host+".node_load1 0.42 ") || !strings.Contains(body, host+".node_scrape_collector_success.collector.loadavg 1 ") {
+		t.Errorf("body:\n%s", body)
+	}
+
+	ln.Close()
+	if err := c.Send(); err == nil {
+		t.Error("send to a closed listener did not fail")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FormatInflux is the InfluxDB line protocol, as read by Telegraf and
+// InfluxDB.
+const FormatInflux = "influx"
+
+func init() {
+	contentTypes[FormatInflux] = "text/plain; charset=utf-8"
+}
+
+// Line protocol escaping: measurements escape commas and spaces, tag keys
+// and values escape equals signs as well.  Newlines cannot be escaped, so
+// they are written as \n.
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// influxField is the field a sample goes in: value for the samples of the
+// family itself, and the suffix for the _bucket, _sum and _count series of
+// histograms and summaries.
+func influxField(f *Family, s Sample) string {
+	if s.Name == "" || s.Name == f.Name {
+		return "value"
+	}
+	return labelName(strings.TrimPrefix(strings.TrimPrefix(s.Name, f.Name), "_"))
+}
+
+// WriteInflux writes the families in InfluxDB line protocol.  Each family is
+// a measurement with its labels as tags and the value in a field, stamped in
+// nanoseconds with the time of the sample or else now.  Values line protocol
+// cannot hold, NaN and the infinities, are left out.
+func WriteInflux(w io.Writer, fams []*Family, now time.Time) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range fams {
+		measurement := measurementEscaper.Replace(f.Name)
+		for _, s := range f.Samples {
+			if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+				continue
+			}
+			bw.WriteString(measurement)
+			for _, k := range s.Labels.Names() {
+				if s.Labels[k] == "" {
+					continue // empty tag values are not allowed
+				}
+				bw.WriteString("," + tagEscaper.Replace(labelName(k)) + "=" + tagEscaper.Replace(s.Labels[k]))
+			}
+			bw.WriteString(" " + influxField(f, s) + "=" + formatValue(s.Value))
+			ts := now.UnixNano()
+			if s.Timestamp != 0 {
+				ts = s.Timestamp * 1e6
+			}
+			bw.WriteString(" " + strconv.FormatInt(ts, 10) + "\n")
+		}
+	}
+	return bw.Flush()
+}
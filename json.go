@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"time"
+)
+
+// JSON formats, for jq and scripts: a single indented document, or one
+// document a line as --interval collects over and over.
+const (
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+)
+
+func init() {
+	contentTypes[FormatJSON] = "application/json"
+	contentTypes[FormatNDJSON] = "application/x-ndjson"
+}
+
+// jsonDocument is one collection: the families keyed by name.
+type jsonDocument struct {
+	Timestamp int64                  `json:"timestamp"` // milliseconds since the epoch
+	Families  map[string]*jsonFamily `json:"families"`
+}
+
+type jsonFamily struct {
+	Type    string       `json:"type"`
+	Help    string       `json:"help,omitempty"`
+	Unit    string       `json:"unit,omitempty"`
+	Samples []jsonSample `json:"samples"`
+}
+
+type jsonSample struct {
+	Name      string      `json:"name,omitempty"` // for _bucket, _sum and _count
+	Labels    Labels      `json:"labels"`
+	Value     interface{} `json:"value"`
+	Timestamp int64       `json:"timestamp,omitempty"`
+}
+
+// WriteJSON writes the families as a JSON document, indented unless it is
+// one line of NDJSON.  Values JSON has no number for, NaN and the
+// infinities, are written as the strings the text format uses.
+func WriteJSON(w io.Writer, fams []*Family, now time.Time, indent bool) error {
+	doc := jsonDocument{Timestamp: now.UnixNano() / 1e6, Families: make(map[string]*jsonFamily, len(fams))}
+	for _, f := range fams {
+		jf := &jsonFamily{Type: f.Type, Help: f.Help, Unit: metricUnit(f.Name), Samples: make([]jsonSample, 0, len(f.Samples))}
+		for _, s := range f.Samples {
+			js := jsonSample{Name: s.Name, Labels: s.Labels, Value: s.Value, Timestamp: s.Timestamp}
+			if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+				js.Value = formatValue(s.Value)
+			}
+			if js.Labels == nil {
+				js.Labels = Labels{}
+			}
+			jf.Samples = append(jf.Samples, js)
+		}
+		doc.Families[f.Name] = jf
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if indent {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(doc)
+}
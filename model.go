@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Labels are the label names and values of a single sample.
+type Labels map[string]string
+
+// With returns a copy of the labels with the others added on top.
+func (l Labels) With(other Labels) Labels {
+	ret := make(Labels, len(l)+len(other))
+	for k, v := range l {
+		ret[k] = v
+	}
+	for k, v := range other {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Names returns the label names in sorted order.
+func (l Labels) Names() []string {
+	return sortedKeys(l)
+}
+
+// key is a canonical form of the labels, used to spot repeated series.
+func (l Labels) key() string {
+	var b strings.Builder
+	for _, k := range l.Names() {
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(l[k])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// less orders label sets by name and then value, with histogram buckets and
+// summary quantiles in numeric order.
+func (l Labels) less(o Labels) bool {
+	a, b := l.Names(), o.Names()
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+		va, vb := l[a[i]], o[b[i]]
+		if va == vb {
+			continue
+		}
+		if a[i] == "le" || a[i] == "quantile" {
+			fa, erra := strconv.ParseFloat(va, 64)
+			fb, errb := strconv.ParseFloat(vb, 64)
+			if erra == nil && errb == nil {
+				return fa < fb
+			}
+		}
+		return va < vb
+	}
+	return len(a) < len(b)
+}
+
+// Sample is one value of a family.  Timestamp is in milliseconds since the
+// epoch and left at zero when the sample carries none.  Name is only set when
+// the sample is named apart from its family, as the _bucket, _sum and _count
+// series of histograms and summaries are.
+type Sample struct {
+	Name      string
+	Labels    Labels
+	Value     float64
+	Timestamp int64
+}
+
+// Family is a named and typed group of samples sharing one help text.
+type Family struct {
+	Name    string
+	Type    string
+	Help    string
+	Samples []Sample
+}
+
+// family returns the named family, creating it on first use.
+func (m *Metrics) family(name, typ, help string) *Family {
+	if m.families == nil {
+		m.families = make(map[string]*Family)
+	}
+	f, ok := m.families[name]
+	if !ok {
+		f = &Family{Name: name, Type: typ, Help: help}
+		m.families[name] = f
+	} else if f.Help == "" {
+		f.Help = help
+	}
+	return f
+}
+
+// Families returns the collected families sorted by name, each with its
+// samples sorted by label set.  Families without samples are left out, and
+// the names follow --compat.
+func (m *Metrics) Families() []*Family {
+	fams := make([]*Family, 0, len(m.families))
+	for _, name := range sortedKeys(m.families) {
+		f := m.families[name]
+		if len(f.Samples) == 0 {
+			continue
+		}
+		sort.SliceStable(f.Samples, func(i, j int) bool {
+			if f.Samples[i].Name != f.Samples[j].Name {
+				return f.Samples[i].Name < f.Samples[j].Name
+			}
+			return f.Samples[i].Labels.less(f.Samples[j].Labels)
+		})
+		fams = append(fams, f)
+	}
+	return applyCompat(fams)
+}
+
+// merge adds the families collected on another Metrics.
+func (m *Metrics) merge(o *Metrics) {
+	for _, name := range sortedKeys(o.families) {
+		f := o.families[name]
+		mf := m.family(f.Name, f.Type, f.Help)
+		mf.Samples = append(mf.Samples, f.Samples...)
+	}
+}
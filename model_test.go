@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLabelsWith(t *testing.T) {
+	base := Labels{"cgroup": "a"}
+	got := base.With(Labels{"core": "0"})
+	if len(base) != 1 {
+		t.Errorf("With modified the receiver: %v", base)
+	}
+	if got["cgroup"] != "a" || got["core"] != "0" {
+		t.Errorf("With = %v", got)
+	}
+	if got := Labels(nil).With(nil); got == nil || len(got) != 0 {
+		t.Errorf("nil.With(nil) = %#v", got)
+	}
+}
+
+// Samples of one family written from different places must come out
+// together, with families and samples in a stable order.
+func TestFamiliesGrouped(t *testing.T) {
+	m := &Metrics{}
+	m.PrintType("node_b", "gauge", "B")
+	m.PrintInt(Labels{"cgroup": "y"}, 2)
+	m.PrintType("node_a", "gauge", "A")
+	m.PrintInt(nil, 1)
+	m.PrintType("node_b", "gauge", "B")
+	m.PrintInt(Labels{"cgroup": "x"}, 3)
+	m.PrintType("node_empty", "gauge", "Nothing")
+
+	want := `# HELP node_a A.
+# TYPE node_a gauge
+node_a 1
+# HELP node_b B.
+# TYPE node_b gauge
+node_b{cgroup="x"} 3
+node_b{cgroup="y"} 2
+`
+	if got := m.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"fmt"
 	//"log"
 	//"net/http"
-	"os/exec"
 	"reflect"
 	"sort"
 	"strconv"
@@ -43,17 +42,17 @@ func main() {
 }
 */
 
-func (m *Metrics) CollectNFTables() {
+func (m *Metrics) CollectNFTables() error {
 	// Open our jsonFile
 	//jsonFile, err := os.Open("/root/go/src/nft_prom/ruleset")
-	jsonFile, err := exec.Command("/usr/sbin/nft", "-j", "list", "ruleset").Output()
+	jsonFile, err := m.Command("/usr/sbin/nft", "-j", "list", "ruleset")
 	//if err != nil {
 	//	log.Fatal(err)
 	//}
 	// if we os.Open returns an error then handle it
 	if err != nil {
 		//fmt.Println(err)
-		return
+		return err
 	}
 
 	//fmt.Println("Successfully Opened file")
@@ -84,20 +83,21 @@ func (m *Metrics) CollectNFTables() {
 			var bytes interface{}
 			var packets interface{}
 			rule_s := rule.(map[string]interface{})
-			keys := []string{}
-			for k, v := range rule_s {
+			keys := Labels{}
+			for _, k := range sortedKeys(rule_s) {
+				v := rule_s[k]
 				if k == "chain" {
 					tablechain := fmt.Sprintf("%v:%v", rule_s["table"], v)
 					iChain[tablechain]++
-					keys = append(keys, fmt.Sprintf("num=\"%d\"", iChain[tablechain]))
+					keys["num"] = strconv.Itoa(iChain[tablechain])
 					//log.Println("table chain", tablechain)
 
 					if strings.HasSuffix(tablechain, size_suffix) && iChain[tablechain] <= len(size_bins) {
 						size := size_bins[iChain[tablechain]-1]
 						if size == 1e10 {
-							keys = append(keys, fmt.Sprintf("le=\"inf\""))
+							keys["le"] = "inf"
 						} else {
-							keys = append(keys, fmt.Sprintf("le=\"%d\"", size))
+							keys["le"] = strconv.Itoa(size)
 						}
 					}
 				}
@@ -112,30 +112,34 @@ func (m *Metrics) CollectNFTables() {
 							//right := match_s["right"](string)
 							switch lv := match_s["left"].(type) {
 							case string:
-								keys = append(keys, fmt.Sprintf("left=%s", strconv.Quote(string(lv))))
+								keys["left"] = lv
+							case json.Number:
+								keys["left"] = lv.String()
 							default:
 								//lvj, _ := json.Marshal(lv)
 								lvj := printMap(lv)
 								//lvj := fmt.Sprintf("%v", lv)
-								keys = append(keys, fmt.Sprintf("left=%s", strconv.Quote(string(lvj))))
+								keys["left"] = lvj
 							}
 
 							switch rv := match_s["right"].(type) {
 							case string:
-								keys = append(keys, fmt.Sprintf("right=%s", strconv.Quote(string(rv))))
+								keys["right"] = rv
+							case json.Number:
+								keys["right"] = rv.String()
 							default:
 								//rvj, _ := json.Marshal(rv)
 								//rvj := fmt.Sprintf("%v", rv)
 								rvj := printMap(rv)
-								keys = append(keys, fmt.Sprintf("right=%s", strconv.Quote(string(rvj))))
+								keys["right"] = rvj
 							}
 
-							keys = append(keys, fmt.Sprintf("op=%s", strconv.Quote(string(match_s["op"].(string)))))
+							keys["op"], _ = match_s["op"].(string)
 						}
 						if ep_s["jump"] != nil {
 							//fmt.Printf("found jump!!! \n", ep_s["jump"])
 							jump_s := (ep_s["jump"]).(map[string]interface{})
-							keys = append(keys, fmt.Sprintf("jump=\"%v\"", jump_s["target"]))
+							keys["jump"] = fmt.Sprintf("%v", jump_s["target"])
 						}
 						if ep_s["counter"] != nil {
 							counter_s := (ep_s["counter"]).(map[string]interface{})
@@ -145,17 +149,17 @@ func (m *Metrics) CollectNFTables() {
 						}
 					}
 				} else {
-					keys = append(keys, fmt.Sprintf("%v=\"%v\"", k, v))
+					keys[k] = fmt.Sprintf("%v", v)
 				}
 			}
 			if bytes != nil {
 				m.PrintType("nftables_rule_bytes_total", "gauge", "nftables rule matched total bytes")
-				m.PrintStr(strings.Join(keys, ","), fmt.Sprintf("%v", bytes))
+				m.PrintStr(keys, fmt.Sprintf("%v", bytes))
 			}
 
 			if packets != nil {
 				m.PrintType("nftables_rule_packets_total", "gauge", "nftables rule matched packets")
-				m.PrintStr(strings.Join(keys, ","), fmt.Sprintf("%v", packets))
+				m.PrintStr(keys, fmt.Sprintf("%v", packets))
 			}
 
 			//fmt.Fprintf(w, "nftables_rule_bytes_total{%s} %v\n", strings.Join(keys, ","), bytes)
@@ -170,6 +174,7 @@ func (m *Metrics) CollectNFTables() {
 	      }
 	*/
 
+	return nil
 }
 func printMap(dat interface{}) string {
 	//fmt.Printf("dat = %v  (%v)\n", dat, reflect.TypeOf(dat).Kind())
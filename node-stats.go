@@ -7,91 +7,193 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 
 	//"compress/gzip"
 	//"encoding/base64"
 	"fmt"
 	//"io"
-	"io/ioutil"
-	//"net"
+	"net"
 	"path/filepath"
 	//"net/http"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
 
 	//"path"
 	"reflect"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 	"unsafe"
 
-	"github.com/araddon/dateparse"
+	apitypes "github.com/docker/docker/api/types"
 	"github.com/pschou/go-params"
 
 	"golang.org/x/crypto/ssh"
-	//"gopkg.in/alecthomas/kingpin.v2"
-	//"gopkg.in/yaml.v2"
-	//"github.com/prometheus/common/log"
-	//"github.com/prometheus/common/version"
 	//"github.com/vishvananda/netlink"
 )
 
-//var (
-//	configFile = kingpin.Flag("config.file", "Remote node exporter configuration file.").Default("remote_node_exporter.yml").String()
-//)
-
-/*var (
-	Port       = os.Getenv("PORT")
-	SshHost    = os.Getenv("SSH_HOST")
-	SshPort    = os.Getenv("SSH_PORT")
-	SshUser    = os.Getenv("SSH_USER")
-	SshPass    = os.Getenv("SSH_PASS")
-	SshKey     = os.Getenv("SSH_KEY")
-	SshScript  = os.Getenv("SSH_SCRIPT")
-	RemoteAddr = os.Getenv("REMOTE_ADDR")
-)*/
-
-/*var TextfilePath string = func() string {
-	s := os.Getenv("TEXTFILE_PATH")
-	if s == "" {
-		s = "/var/lib/prometheus/node-exporter"
-	}
-	return strings.TrimSuffix(s, "/") + "/"
-}()*/
-
-// var Dockers = []types.Container{}
-var dms = make(map[string]string, 0)
-var blk_dev = make(map[string]string, 0)
-var docker_labels = make(map[string]string, 0)
-var msec string
-
-var service_list = make(map[string]struct{}, 0)
-
-var PreReadFileList []string = []string{
-	"/etc/storage/system_time",
-	"/proc/diskstats",
-	"/proc/driver/rtc",
-	"/proc/loadavg",
-	"/proc/meminfo",
-	"/proc/mounts",
-	"/proc/net/arp",
-	"/proc/net/dev",
-	"/proc/net/netstat",
-	"/proc/net/snmp",
-	"/proc/net/sockstat",
-	"/proc/stat",
-	"/proc/sys/fs/file-nr",
-	"/proc/sys/kernel/random/entropy_avail",
-	"/proc/sys/net/netfilter/nf_conntrack_count",
-	"/proc/sys/net/netfilter/nf_conntrack_max",
-	"/proc/vmstat",
-	"/tmp/proc/mdstat",
-	//TextfilePath + "*.prom",
+// scrape is what the collectors of one scrape learn for each other: the
+// containers and their labels from docker, and the services seen in the
+// cgroup walks.  Each scrape starts afresh, so a target never sees what was
+// found on another, and scrapes of different targets run side by side.
+type scrape struct {
+	mu           sync.Mutex
+	dockers      map[string]apitypes.ContainerJSON
+	dockerLabels map[string]Labels
+	services     map[string]struct{}
+}
+
+// shared is the state of the scrape the Metrics are part of, started by the
+// first call.
+func (m *Metrics) shared() *scrape {
+	if m.scrape == nil {
+		m.scrape = &scrape{
+			dockers:      make(map[string]apitypes.ContainerJSON),
+			dockerLabels: make(map[string]Labels),
+			services:     make(map[string]struct{}),
+		}
+	}
+	return m.scrape
+}
+
+// addService records a systemd service seen in the cgroup walks, which run
+// side by side.
+func (m *Metrics) addService(id string) {
+	sc := m.shared()
+	sc.mu.Lock()
+	sc.services[id] = struct{}{}
+	sc.mu.Unlock()
+}
+
+func (m *Metrics) services() []string {
+	sc := m.shared()
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sortedKeys(sc.services)
+}
+
+// setDockers records the containers found by the docker collector.
+func (m *Metrics) setDockers(dockers map[string]apitypes.ContainerJSON) {
+	sc := m.shared()
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.dockers = dockers
+	for id, d := range dockers {
+		sc.dockerLabels[id] = Labels{"docker_name": d.Name, "docker_image": d.Image}
+	}
+}
+
+// sortedDockers returns the containers ordered by ID.
+func (m *Metrics) sortedDockers() []apitypes.ContainerJSON {
+	sc := m.shared()
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	ds := make([]apitypes.ContainerJSON, 0, len(sc.dockers))
+	for _, id := range sortedKeys(sc.dockers) {
+		ds = append(ds, sc.dockers[id])
+	}
+	return ds
+}
+
+// dockerLabels are the labels of the samples of a container.
+func (m *Metrics) dockerLabels(id string) Labels {
+	sc := m.shared()
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.dockerLabels[id]
+}
+
+var (
+	procPath   = "/proc"
+	sysPath    = "/sys"
+	rootfsPath = "/"
+)
+
+func procFilePath(name string) string {
+	return filepath.Join(procPath, name)
+}
+
+func sysFilePath(name string) string {
+	return filepath.Join(sysPath, name)
+}
+
+func rootfsFilePath(name string) string {
+	return filepath.Join(rootfsPath, name)
+}
+
+// rootfsStripPrefix rewrites a path seen through --path.rootfs to where it
+// lives on the host.
+func rootfsStripPrefix(path string) string {
+	if rootfsPath == "/" {
+		return path
+	}
+	if path == rootfsPath {
+		return "/"
+	}
+	if strings.HasPrefix(path, rootfsPath+"/") {
+		return path[len(rootfsPath):]
+	}
+	return path
+}
+
+// inRootfs reports if the path is on the host, under --path.rootfs.
+func inRootfs(path string) bool {
+	return rootfsPath == "/" || path == rootfsPath || strings.HasPrefix(path, rootfsPath+"/")
+}
+
+// PreReadFileList is every file a scrape reads, which a remote host is asked
+// for in one go.  Entries may be glob patterns.
+func PreReadFileList() []string {
+	files := []string{
+		rootfsFilePath("etc/storage/system_time"),
+		rootfsFilePath("etc/system-release"),
+		procFilePath("1/mounts"),
+		procFilePath("diskstats"),
+		procFilePath("driver/rtc"),
+		procFilePath("loadavg"),
+		procFilePath("meminfo"),
+		procFilePath("mounts"),
+		procFilePath("net/arp"),
+		procFilePath("net/dev"),
+		procFilePath("net/netstat"),
+		procFilePath("net/snmp"),
+		procFilePath("net/sockstat"),
+		procFilePath("stat"),
+		procFilePath("sys/fs/file-nr"),
+		procFilePath("sys/kernel/pid_max"),
+		procFilePath("sys/kernel/random/entropy_avail"),
+		procFilePath("sys/kernel/threads-max"),
+		procFilePath("sys/net/netfilter/nf_conntrack_count"),
+		procFilePath("sys/net/netfilter/nf_conntrack_max"),
+		procFilePath("sys/vm/max_map_count"),
+		procFilePath("vmstat"),
+		rootfsFilePath("tmp/proc/mdstat"),
+		sysFilePath("block/dm-*/dm/name"),
+	}
+	if textfileDirectory != "" {
+		files = append(files, filepath.Join(textfileDirectory, "*.prom"))
+	}
+	return files
+}
+
+// PreReadTrees are the cgroup hierarchies walked in a scrape, with the files
+// read from each of their directories.
+func PreReadTrees() map[string][]string {
+	return map[string][]string{
+		sysFilePath("fs/cgroup/memory"): {
+			"memory.stat", "memory.usage_in_bytes", "memory.memsw.usage_in_bytes", "memory.swappiness",
+			"memory.limit_in_bytes", "memory.memsw.limit_in_bytes", "memsw.max_usage_in_bytes",
+		},
+		sysFilePath("fs/cgroup/cpu,cpuacct"): {"cpuacct.usage_percpu", "cpu.shares"},
+		sysFilePath("fs/cgroup/blkio"):       {"blkio.throttle.io_serviced", "blkio.throttle.io_service_bytes"},
+	}
 }
 
 var split func(string, int) []string = regexp.MustCompile(`\s+`).Split
@@ -103,13 +205,17 @@ type Client struct {
 	client     *ssh.Client
 	timeOffset time.Duration
 	hasTimeout bool
-	script     string
+	scripts    []string // run by the script collector for this host only
 	mu         sync.Mutex
+	sessions   chan struct{} // limits the sessions open at once
+
+	keys       []ssh.Signer // from the private key file
+	agent      net.Conn     // to the ssh-agent, open during the handshake
+	knownHosts string       // file of host keys, empty when not checked
 }
 
+// connect dials the host unless the client is already connected.
 func (c *Client) connect() error {
-	c.client = nil
-
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -117,8 +223,19 @@ func (c *Client) connect() error {
 		return nil
 	}
 
+	config := c.Config
+	if algos := knownAlgorithms(c.knownHosts, c.Addr); len(algos) > 0 && len(c.Config.HostKeyAlgorithms) == 0 {
+		cc := *c.Config
+		cc.HostKeyAlgorithms = algos
+		config = &cc
+	}
+
 	var err error
-	c.client, err = ssh.Dial("tcp", c.Addr, c.Config)
+	c.client, err = ssh.Dial("tcp", c.Addr, config)
+	if c.agent != nil {
+		c.agent.Close()
+		c.agent = nil
+	}
 
 	if err != nil {
 		log.Printf("ssh.Dial(\"tcp\", %#v, ...) error: %+v\n", c.Addr, err)
@@ -150,7 +267,7 @@ func (c *Client) connect() error {
 		}
 
 	}
-	if parts[1] == "0" {
+	if len(parts) > 1 && parts[1] == "0" {
 		c.hasTimeout = true
 	}
 	log.Printf("%#v timezone is %+v, has timeout command is %+v\n", c.Addr, c.timeOffset, c.hasTimeout)
@@ -163,36 +280,82 @@ func (c *Client) TimeOffset() time.Duration {
 	return c.timeOffset
 }
 
+// reconnect drops a connection which stopped working and dials again.
+func (c *Client) reconnect(old *ssh.Client) error {
+	c.drop(old)
+	return c.connect()
+}
+
+// Close drops the connection to the host, which is dialed again on the next
+// command.
+func (c *Client) Close() {
+	c.mu.Lock()
+	conn := c.client
+	c.mu.Unlock()
+	c.drop(conn)
+}
+
+// drop closes the connection unless another has replaced it already.
+func (c *Client) drop(old *ssh.Client) {
+	c.mu.Lock()
+	if c.client == old && old != nil {
+		old.Close()
+		c.client = nil
+	}
+	c.mu.Unlock()
+}
+
 func (c *Client) Execute(cmd string) (string, error) {
-	log.Printf("%T.Execute(%#v)\n", c, cmd)
+	return c.ExecuteContext(context.Background(), cmd)
+}
 
-	//if c.client == nil {
-	//	c.connect()
-	//}
+// ExecuteContext runs a shell command on the host and returns what it wrote
+// to stdout.  The command is killed when the context is done.
+func (c *Client) ExecuteContext(ctx context.Context, cmd string) (string, error) {
+	if c.sessions != nil {
+		select {
+		case c.sessions <- struct{}{}:
+			defer func() { <-c.sessions }()
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
 
+	var session *ssh.Session
 	retry := 2
 	for i := 0; i < retry; i += 1 {
-		session, err := c.client.NewSession()
-		if err != nil {
-			if i < retry-1 {
-				log.Printf("NewSession() error: %+v, reconnecting...\n", err)
-				c.client.Close()
-				c.connect()
-				continue
-			}
+		if err := c.connect(); err != nil {
 			return "", err
 		}
-		defer session.Close()
+		c.mu.Lock()
+		client := c.client
+		c.mu.Unlock()
 
-		var b bytes.Buffer
-		session.Stdout = &b
+		var err error
+		session, err = client.NewSession()
+		if err == nil {
+			break
+		}
+		if i == retry-1 {
+			return "", err
+		}
+		log.Printf("NewSession() error: %+v, reconnecting...\n", err)
+		c.reconnect(client)
+	}
+	defer session.Close()
 
-		err = session.Run(cmd)
+	var b bytes.Buffer
+	session.Stdout = &b
 
+	done := make(chan error, 1)
+	go func() { done <- session.Run(cmd) }()
+	select {
+	case err := <-done:
 		return b.String(), err
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		return "", ctx.Err()
 	}
-
-	return "", nil
 }
 
 type ProcFile struct {
@@ -284,158 +447,113 @@ func (pf ProcFile) KVS() ([]string, map[string][]string) {
 }
 
 type Metrics struct {
-	Client *Client
-
-	name string
-	body bytes.Buffer
-	//preread map[string]string
-	metric_count map[string]int
+	Client    *Client
+	FS        FS
+	Format    string
+	Timestamp int64 // milliseconds, stamped on every sample when set
+
+	// NoScrapeFamilies leaves out node_scrape_collector_*, for the textfile
+	// collector of a node_exporter, which has those of its own.
+	NoScrapeFamilies bool
+
+	ctx      context.Context
+	scrape   *scrape
+	current  *Family
+	families map[string]*Family
 }
 
-/*
-func (m *Metrics) PreRead() error {
-	m.preread = make(map[string]string)
-
-	cmd := "/bin/fgrep \"\" " + strings.Join(PreReadFileList, " ")
-
-	output, _ := m.Client.Execute(cmd)
-
-	split := func(s string) map[string]string {
-		m := make(map[string]string)
-		var lastname string
-		var b bytes.Buffer
-
-		scanner := bufio.NewScanner(strings.NewReader(s))
-		for scanner.Scan() {
-			parts := strings.SplitN(scanner.Text(), ":", 2)
-			if len(parts) != 2 {
-				continue
-			}
-
-			filename := strings.TrimSpace(parts[0])
-			line := parts[1]
-
-			if filename != lastname {
-				if lastname != "" {
-					m[lastname] = b.String()
-				}
-				b.Reset()
-				lastname = filename
-			}
+func (m *Metrics) ReadFile(filename string) (string, error) {
+	s, err := m.fs().ReadFile(filename)
+	return string(s), err
+}
 
-			b.WriteString(line)
-			b.WriteString("\n")
-		}
-		m[lastname] = b.String()
-		return m
+// context is the deadline of the collector the Metrics were handed to.
+func (m *Metrics) context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
 	}
+	return m.ctx
+}
 
-	m.preread = split(output)
+// Command runs a command, giving up when the collector runs out of time.
+func (m *Metrics) Command(name string, arg ...string) ([]byte, error) {
+	return m.fs().Command(m.context(), name, arg...)
+}
 
-	for _, filename := range PreReadFileList {
-		if _, ok := m.preread[filename]; !ok {
-			m.preread[filename] = ""
+func (m *Metrics) fs() FS {
+	switch {
+	case m.FS != nil:
+		if fs, ok := m.FS.(contextFS); ok && m.ctx != nil {
+			return fs.withContext(m.ctx)
 		}
+		return m.FS
+	case m.Client != nil:
+		return remoteFS{c: m.Client, ctx: m.context()}
 	}
+	return hostFS
+}
 
-	return nil
-}*/
-
-/*func (m *Metrics) Files() []string {
-	files := []string{}
-	for f := range m.preread {
-		files = append(files, f)
+// sortedKeys lets the collectors walk their maps in a stable order.
+func sortedKeys[V any](kv map[string]V) []string {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
 	}
-	return files
-}*/
-
-func (m *Metrics) ReadFile(filename string) (string, error) {
-	//s, ok := m.preread[filename]
-	//if ok {
-	//	return s, nil
-	//}
-
-	//return m.Client.Execute("/bin/cat " + filename)
-	s, err := ioutil.ReadFile(filename)
-	return string(s), err
+	sort.Strings(keys)
+	return keys
 }
 
+// PrintType selects the family the following samples belong to.
 func (m *Metrics) PrintType(name string, typ string, help string) {
-	if m.metric_count == nil {
-		m.metric_count = make(map[string]int, 0)
-	}
-	m.name = name
-	if m.metric_count[name] == 0 {
-		if help != "" {
-			m.body.WriteString(fmt.Sprintf("# HELP %s %s.\n", name, help))
-		}
-		m.body.WriteString(fmt.Sprintf("# TYPE %s %s\n", name, typ))
-	}
-	m.metric_count[name]++
+	m.current = m.family(name, typ, help)
 }
 
-func (m *Metrics) PrintFloat(labels string, value float64) {
-	if labels != "" {
-		m.body.WriteString(fmt.Sprintf("%s{%s} ", m.name, labels))
-	} else {
-		m.body.WriteString(fmt.Sprintf("%s ", m.name))
-	}
-
-	m.body.WriteString(fmt.Sprintf("%-16g%s\n", value, msec))
-	//if value >= 1000000 {
-	//	m.body.WriteString(fmt.Sprintf("%e\n", value))
-	//} else {
-	//	m.body.WriteString(fmt.Sprintf("%f\n", value))
-	//}
+func (m *Metrics) PrintFloat(labels Labels, value float64) {
+	m.current.Samples = append(m.current.Samples, Sample{Labels: labels, Value: value, Timestamp: m.Timestamp})
 }
 
-func (m *Metrics) PrintBool(labels string, value bool) {
-	if labels != "" {
-		m.body.WriteString(fmt.Sprintf("%s{%s} ", m.name, labels))
-	} else {
-		m.body.WriteString(fmt.Sprintf("%s ", m.name))
-	}
-
+func (m *Metrics) PrintBool(labels Labels, value bool) {
 	if value {
-		m.body.WriteString(fmt.Sprintf("1%s\n", msec))
+		m.PrintFloat(labels, 1)
 	} else {
-		m.body.WriteString(fmt.Sprintf("0%s\n", msec))
+		m.PrintFloat(labels, 0)
 	}
 }
 
-func (m *Metrics) PrintStr(labels string, value string) {
-	if labels != "" {
-		m.body.WriteString(fmt.Sprintf("%s{%s} ", m.name, labels))
-	} else {
-		m.body.WriteString(fmt.Sprintf("%s ", m.name))
+// PrintStr adds a sample read as text, values which do not parse are dropped.
+func (m *Metrics) PrintStr(labels Labels, value string) {
+	if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+		m.PrintFloat(labels, v)
 	}
-
-	m.body.WriteString(fmt.Sprintf("%s%s\n", value, msec))
 }
 
-func (m *Metrics) PrintInt(labels string, value int64) {
-	if labels != "" {
-		m.body.WriteString(fmt.Sprintf("%s{%s} ", m.name, labels))
-	} else {
-		m.body.WriteString(fmt.Sprintf("%s ", m.name))
-	}
-
-	//if value >= 1000000 {
-	//	m.body.WriteString(fmt.Sprintf("%g\n", float64(value)))
-	//} else {
-	m.body.WriteString(fmt.Sprintf("%d%s\n", value, msec))
-	//}
+func (m *Metrics) PrintInt(labels Labels, value int64) {
+	m.PrintFloat(labels, float64(value))
 }
 
-func (m *Metrics) PrintRaw(s string) {
-	m.body.WriteString(s)
+// String renders the collected families in the selected format.
+func (m *Metrics) String() string {
+	var b bytes.Buffer
+	switch m.Format {
+	case FormatInflux:
+		WriteInflux(&b, m.Families(), time.Now())
+	case FormatGraphite:
+		WriteGraphite(&b, m.Families(), m.host(), graphiteTemplates, time.Now())
+	case FormatJSON, FormatNDJSON:
+		WriteJSON(&b, m.Families(), time.Now(), m.Format == FormatJSON)
+	case FormatProtobuf:
+		WriteProtobuf(&b, m.Families())
+	default:
+		WriteText(&b, m.Format, m.Families())
+	}
+	return b.String()
 }
 
 func (m *Metrics) CollectTime() error {
 	var t time.Time
 	var nsec int64
 
-	s, err := m.ReadFile("/proc/driver/rtc")
+	s, err := m.ReadFile(procFilePath("driver/rtc"))
 
 	if s != "" {
 		_, kv := (ProcFile{Text: s, Sep: ":"}).KV()
@@ -446,18 +564,22 @@ func (m *Metrics) CollectTime() error {
 	}
 
 	if nsec == 0 {
-		s, err = m.ReadFile("/etc/storage/system_time")
+		s, err = m.ReadFile(rootfsFilePath("etc/storage/system_time"))
 		nsec, err = (ProcFile{Text: s}).Int()
 	}
 
-	if nsec == 0 {
-		s, err = m.Client.Execute("date +%s")
+	if nsec == 0 && m.Client != nil {
+		s, err = m.Client.ExecuteContext(m.context(), "date +%s")
 		nsec, err = (ProcFile{Text: s}).Int()
 	}
 
+	if nsec == 0 {
+		nsec, err = time.Now().Unix(), nil
+	}
+
 	if nsec != 0 {
 		m.PrintType("node_time", "counter", "System time in seconds since epoch (1970)")
-		m.PrintInt("", nsec)
+		m.PrintInt(nil, nsec)
 		//msec = nsec * 1e3
 	}
 
@@ -465,7 +587,7 @@ func (m *Metrics) CollectTime() error {
 }
 
 func (m *Metrics) CollectLoadavg() error {
-	s, err := m.ReadFile("/proc/loadavg")
+	s, err := m.ReadFile(procFilePath("loadavg"))
 	if err != nil {
 		return err
 	}
@@ -476,20 +598,20 @@ func (m *Metrics) CollectLoadavg() error {
 	}
 
 	m.PrintType("node_load1", "gauge", "1m load average")
-	m.PrintStr("", parts[0])
+	m.PrintStr(nil, parts[0])
 	m.PrintType("node_load5", "gauge", "5m load average")
-	m.PrintStr("", parts[1])
-	m.PrintType("node_load15", "gauge", "5m load average")
-	m.PrintStr("", parts[2])
+	m.PrintStr(nil, parts[1])
+	m.PrintType("node_load15", "gauge", "15m load average")
+	m.PrintStr(nil, parts[2])
 
 	m.PrintType("node_procs_threads", "gauge", "Thread count")
-	m.PrintStr("", strings.SplitN(parts[3], "/", 2)[1])
+	m.PrintStr(nil, strings.SplitN(parts[3], "/", 2)[1])
 
 	return nil
 }
 
 func (m *Metrics) CollectFilefd() error {
-	s, err := m.ReadFile("/proc/sys/fs/file-nr")
+	s, err := m.ReadFile(procFilePath("sys/fs/file-nr"))
 	parts := (ProcFile{Text: s}).Strings()
 
 	if len(parts) < 3 {
@@ -498,12 +620,12 @@ func (m *Metrics) CollectFilefd() error {
 
 	if allocated, err := strconv.ParseInt(parts[0], 10, 64); err == nil {
 		m.PrintType("node_filefd_allocated", "gauge", "File descriptor statistics: allocated")
-		m.PrintInt("", allocated)
+		m.PrintInt(nil, allocated)
 	}
 
 	if maximum, err := strconv.ParseInt(parts[2], 10, 64); err == nil {
 		m.PrintType("node_filefd_maximum", "gauge", "File descriptor statistics: maximum")
-		m.PrintInt("", maximum)
+		m.PrintInt(nil, maximum)
 	}
 
 	return err
@@ -514,19 +636,19 @@ func (m *Metrics) CollectNfConntrack() error {
 	var n int64
 	var err error
 
-	s, err = m.ReadFile("/proc/sys/net/netfilter/nf_conntrack_count")
+	s, err = m.ReadFile(procFilePath("sys/net/netfilter/nf_conntrack_count"))
 	if s != "" {
 		if n, err = (ProcFile{Text: s}).Int(); err == nil {
 			m.PrintType("node_nf_conntrack_entries", "gauge", "Number of currently allocated flow entries for connection tracking")
-			m.PrintInt("", n)
+			m.PrintInt(nil, n)
 		}
 	}
 
-	s, err = m.ReadFile("/proc/sys/net/netfilter/nf_conntrack_max")
+	s, err = m.ReadFile(procFilePath("sys/net/netfilter/nf_conntrack_max"))
 	if s != "" {
 		if n, err = (ProcFile{Text: s}).Int(); err == nil {
 			m.PrintType("node_nf_conntrack_entries_limit", "gauge", "Maximum size of connection tracking table")
-			m.PrintInt("", n)
+			m.PrintInt(nil, n)
 		}
 	}
 
@@ -534,25 +656,35 @@ func (m *Metrics) CollectNfConntrack() error {
 }
 
 func (m *Metrics) CollectKernel() error {
-	out, err := exec.Command("/usr/bin/uname", "-r").Output()
+	out, err := m.Command("/usr/bin/uname", "-r")
+	if err != nil {
+		return err
+	}
 	m.PrintType("node_kernel_info", "gauge", "Running kernel")
-	m.PrintInt(fmt.Sprintf("version=%q", strings.TrimSpace(string(out))), 1)
-	sr, err := os.Open("/etc/system-release")
+	m.PrintInt(Labels{"version": strings.TrimSpace(string(out))}, 1)
+
+	// Only the Red Hat family has a system-release file, so it going missing
+	// is no failure
+	sr, err := m.ReadFile(rootfsFilePath("etc/system-release"))
 	if err == nil {
-		defer sr.Close()
-		dat := make([]byte, 256)
-		ct, _ := sr.Read(dat)
-		parts := strings.SplitN(strings.TrimSpace(string(dat[:ct])), " release ", 2)
+		parts := strings.SplitN(strings.TrimSpace(sr), " release ", 2)
 		if len(parts) == 2 {
 			m.PrintType("node_system_release_info", "gauge", "System Release Info")
-			m.PrintInt(fmt.Sprintf("name=%q,version=%q", parts[0], parts[1]), 1)
+			m.PrintInt(Labels{"name": parts[0], "version": parts[1]}, 1)
 		}
 	}
-	return err
+	return nil
 }
+
+// CollectSystemd reports the services seen in the cgroup walks, failing when
+// systemctl could not tell of one.
 func (m *Metrics) CollectSystemd() error {
-	for proc := range service_list {
-		out, err := exec.Command("/usr/bin/systemctl", "--no-pager", "show", proc).Output()
+	var failed error
+	for _, proc := range m.services() {
+		out, err := m.Command("/usr/bin/systemctl", "--no-pager", "show", proc)
+		if err != nil && failed == nil {
+			failed = fmt.Errorf("systemctl show %s: %v", proc, err)
+		}
 		if err == nil {
 			prop := make(map[string]string, 0)
 			for _, line := range strings.Split(string(out), "\n") {
@@ -564,27 +696,27 @@ func (m *Metrics) CollectSystemd() error {
 			}
 			m.PrintType("node_systemd_unit_state", "gauge", "Systemd unit's current state")
 			for _, state := range []string{"activating", "active", "deactiviating", "failed", "inactive"} {
-				m.PrintBool(fmt.Sprintf("name=%q,state=%q", proc, state), state == prop["ActiveState"])
+				m.PrintBool(Labels{"name": proc, "state": state}, state == prop["ActiveState"])
 			}
 
 			m.PrintType("node_systemd_unit_start_time_seconds", "gauge", "Systemd start time since boot")
 			//val, _ := time.Parse("2006-01-02T15:04:05.000Z", prop["ActiveEnterTimestamp"])
 			//m.PrintInt(fmt.Sprintf("name=%q", proc), val.Unix())
 			val, _ := strconv.ParseUint(prop["ExecMainStartTimestampMonotonic"], 10, 64)
-			m.PrintStr(fmt.Sprintf("name=%q", proc), fmt.Sprintf("%d.%06d", val/1e6, val%1e6))
+			m.PrintStr(Labels{"name": proc}, fmt.Sprintf("%d.%06d", val/1e6, val%1e6))
 		}
 	}
-	//fmt.Println("NS err = ", err)
-	return nil
+	return failed
 }
 
 func (m *Metrics) CollectMemory() error {
-	s, err := m.ReadFile("/proc/meminfo")
+	s, err := m.ReadFile(procFilePath("meminfo"))
 	s = strings.Replace(strings.Replace(s, "(", "_", -1), ")", "", -1)
 
 	_, kv := (ProcFile{Text: s, Sep: ":"}).KV()
 
-	for key, value := range kv {
+	for _, key := range sortedKeys(kv) {
+		value := kv[key]
 		//fmt.Printf("memory - key  %v value %v\n", key, value)
 		parts := split(value, -1)
 		if len(parts) == 0 {
@@ -603,28 +735,26 @@ func (m *Metrics) CollectMemory() error {
 		}
 
 		m.PrintType(fmt.Sprintf("node_memory_%s"+unit, key), "gauge", "")
-		m.PrintInt("", size)
+		m.PrintInt(nil, size)
 	}
-	err = filepath.Walk("/sys/fs/cgroup/memory", func(path string, info os.FileInfo, err error) error {
+	root := sysFilePath("fs/cgroup/memory")
+	err = m.fs().Walk(root, func(path string, info os.FileInfo, err error) error {
 		if info != nil && info.Name() == "memory.stat" {
-			t := filepath.Dir(path[22:])
+			rel, _ := filepath.Rel(root, path)
+			t := filepath.Dir(rel)
 			if t != "." {
-				lbl := ""
+				lbl := Labels{"cgroup": t}
 				if strings.HasPrefix(t, "docker/") {
 					docker_id := strings.TrimSuffix(t[7:], ".scope")
-					if docker_labels[docker_id] != "" {
-						lbl = "," + docker_labels[docker_id]
-					}
+					lbl = lbl.With(m.dockerLabels(docker_id))
 				} else if strings.HasPrefix(t, "system.slice/docker-") {
 					docker_id := strings.TrimSuffix(t[20:], ".scope")
-					if docker_labels[docker_id] != "" {
-						lbl = "," + docker_labels[docker_id]
-					}
+					lbl = lbl.With(m.dockerLabels(docker_id))
 				}
 				if strings.HasPrefix(t, "system.slice/") && strings.HasSuffix(t, ".service") {
 					service_id := t[13 : len(t)-8]
-					service_list[service_id] = struct{}{}
-					lbl = fmt.Sprintf("%s,service=\"%s\"", lbl, service_id)
+					m.addService(service_id)
+					lbl["service"] = service_id
 				}
 
 				s, _ := m.ReadFile(path)
@@ -635,42 +765,42 @@ func (m *Metrics) CollectMemory() error {
 						continue
 					}
 					m.PrintType(fmt.Sprintf("node_cgroup_memory_%s", parts[0]), "gauge", "")
-					m.PrintStr(fmt.Sprintf("cgroup=\"%s\"%s", t, lbl), parts[1])
+					m.PrintStr(lbl, parts[1])
 				}
 
 				s, _ = m.ReadFile(filepath.Dir(path) + "/memory.usage_in_bytes")
 				if strings.TrimSpace(s) != "0" {
 					m.PrintType(fmt.Sprintf("node_cgroup_memory_bytes"), "gauge", "")
-					m.PrintStr(fmt.Sprintf("cgroup=\"%s\"%s", t, lbl), strings.TrimSpace(s))
+					m.PrintStr(lbl, strings.TrimSpace(s))
 
 					s, err := m.ReadFile(filepath.Dir(path) + "/memory.memsw.usage_in_bytes")
 					if err == nil {
 						m.PrintType(fmt.Sprintf("node_cgroup_memory_swap_bytes"), "gauge", "")
-						m.PrintStr(fmt.Sprintf("cgroup=\"%s\"%s", t, lbl), strings.TrimSpace(s))
+						m.PrintStr(lbl, strings.TrimSpace(s))
 					}
 
 					s, err = m.ReadFile(filepath.Dir(path) + "/memory.swappiness")
 					if err == nil {
 						m.PrintType(fmt.Sprintf("node_cgroup_memory_swappiness"), "gauge", "")
-						m.PrintStr(fmt.Sprintf("cgroup=\"%s\"%s", t, lbl), strings.TrimSpace(s))
+						m.PrintStr(lbl, strings.TrimSpace(s))
 					}
 
 					s, err = m.ReadFile(filepath.Dir(path) + "/memory.limit_in_bytes")
 					if err == nil {
 						m.PrintType(fmt.Sprintf("node_cgroup_memory_limit_bytes"), "gauge", "")
-						m.PrintStr(fmt.Sprintf("cgroup=\"%s\"%s", t, lbl), strings.TrimSpace(s))
+						m.PrintStr(lbl, strings.TrimSpace(s))
 					}
 
 					s, err = m.ReadFile(filepath.Dir(path) + "/memory.memsw.limit_in_bytes")
 					if err == nil {
 						m.PrintType(fmt.Sprintf("node_cgroup_memory_swap_limit_bytes"), "gauge", "")
-						m.PrintStr(fmt.Sprintf("cgroup=\"%s\"%s", t, lbl), strings.TrimSpace(s))
+						m.PrintStr(lbl, strings.TrimSpace(s))
 					}
 
 					s, err = m.ReadFile(filepath.Dir(path) + "/memsw.max_usage_in_bytes")
 					if err == nil {
 						m.PrintType(fmt.Sprintf("node_cgroup_memory_max_usage_bytes"), "gauge", "")
-						m.PrintStr(fmt.Sprintf("cgroup=\"%s\"%s", t, lbl), strings.TrimSpace(s))
+						m.PrintStr(lbl, strings.TrimSpace(s))
 					}
 				}
 			}
@@ -685,11 +815,12 @@ func (m *Metrics) CollectNetstat() error {
 	var s1, s2 string
 	var err error
 
-	s1, err = m.ReadFile("/proc/net/netstat")
-	s2, err = m.ReadFile("/proc/net/snmp")
+	s1, err = m.ReadFile(procFilePath("net/netstat"))
+	s2, err = m.ReadFile(procFilePath("net/snmp"))
 	_, kv := (ProcFile{Text: (s1 + s2), Sep: ":"}).KVS()
 
-	for key, values := range kv {
+	for _, key := range sortedKeys(kv) {
+		values := kv[key]
 		if len(values) != 2 {
 			continue
 		}
@@ -703,7 +834,7 @@ func (m *Metrics) CollectNetstat() error {
 				continue
 			}
 			m.PrintType(fmt.Sprintf("node_netstat_%s_%s", key, v), "gauge", "")
-			m.PrintInt("", n)
+			m.PrintInt(nil, n)
 		}
 	}
 
@@ -711,10 +842,11 @@ func (m *Metrics) CollectNetstat() error {
 }
 
 func (m *Metrics) CollectSockstat() error {
-	s, err := m.ReadFile("/proc/net/sockstat")
+	s, err := m.ReadFile(procFilePath("net/sockstat"))
 	_, kv := (ProcFile{Text: s, Sep: ":"}).KV()
 
-	for key, value := range kv {
+	for _, key := range sortedKeys(kv) {
+		value := kv[key]
 		vs := split(value, -1)
 		for i := 0; i < len(vs)-1; i += 2 {
 			k := vs[i]
@@ -723,7 +855,7 @@ func (m *Metrics) CollectSockstat() error {
 				continue
 			}
 			m.PrintType(fmt.Sprintf("node_sockstat_%s_%s", key, k), "gauge", "")
-			m.PrintInt("", n)
+			m.PrintInt(nil, n)
 		}
 	}
 
@@ -731,16 +863,17 @@ func (m *Metrics) CollectSockstat() error {
 }
 
 func (m *Metrics) CollectVmstat() error {
-	s, err := m.ReadFile("/proc/vmstat")
+	s, err := m.ReadFile(procFilePath("vmstat"))
 	_, kv := (ProcFile{Text: s}).KV()
 
-	for key, value := range kv {
+	for _, key := range sortedKeys(kv) {
+		value := kv[key]
 		n, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
 			continue
 		}
 		m.PrintType(fmt.Sprintf("node_vmstat_%s", key), "gauge", "")
-		m.PrintInt("", n)
+		m.PrintInt(nil, n)
 	}
 
 	return err
@@ -760,27 +893,27 @@ var CPUModes []string = []string{
 }
 
 func (m *Metrics) CollectStat() error {
-	s, err := m.ReadFile("/proc/stat")
+	s, err := m.ReadFile(procFilePath("stat"))
 	_, kv := (ProcFile{Text: s}).KV()
 
 	if v, ok := kv["btime"]; ok {
 		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
 			m.PrintType("node_boot_time", "gauge", "Node boot time, in unixtime")
-			m.PrintInt("", n)
+			m.PrintInt(nil, n)
 		}
 	}
 
 	if v, ok := kv["ctxt"]; ok {
 		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
 			m.PrintType("node_context_switches", "counter", "Total number of context switches")
-			m.PrintInt("", n)
+			m.PrintInt(nil, n)
 		}
 	}
 
 	if v, ok := kv["processes"]; ok {
 		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
 			m.PrintType("node_forks", "counter", "Total number of forks")
-			m.PrintInt("", n)
+			m.PrintInt(nil, n)
 		}
 	}
 
@@ -788,27 +921,28 @@ func (m *Metrics) CollectStat() error {
 		vs := split(v, -1)
 		if n, err := strconv.ParseInt(vs[0], 10, 64); err == nil {
 			m.PrintType("node_intr", "counter", "Total number of interrupts serviced")
-			m.PrintInt("", n)
+			m.PrintInt(nil, n)
 		}
 	}
 
 	if v, ok := kv["procs_blocked"]; ok {
 		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
 			m.PrintType("node_procs_blocked", "gauge", "Number of processes blocked waiting for I/O to complete")
-			m.PrintInt("", n)
+			m.PrintInt(nil, n)
 		}
 	}
 
 	if v, ok := kv["procs_running"]; ok {
 		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
 			m.PrintType("node_procs_running", "gauge", "Number of processes in runnable state")
-			m.PrintInt("", n)
+			m.PrintInt(nil, n)
 		}
 	}
 
 	m.PrintType("node_cpu_seconds", "counter", "Seconds the cpus spent in each mode")
 	cores := int64(0)
-	for key, value := range kv {
+	for _, key := range sortedKeys(kv) {
+		value := kv[key]
 		if key == "cpu" || !strings.HasPrefix(key, "cpu") {
 			continue
 		}
@@ -820,33 +954,31 @@ func (m *Metrics) CollectStat() error {
 				break
 			}
 			if n, err := strconv.ParseInt(vs[i], 10, 64); err == nil {
-				m.PrintStr(fmt.Sprintf("cpu=\"%s\",mode=\"%s\"", key, mode), fmt.Sprintf("%d.%02d", n/100, n%100))
+				m.PrintStr(Labels{"cpu": key, "mode": mode}, fmt.Sprintf("%d.%02d", n/100, n%100))
 			}
 		}
 	}
 	m.PrintType("node_cpu_count", "gauge", "Core count")
-	m.PrintInt("", cores)
+	m.PrintInt(nil, cores)
 
-	err = filepath.Walk("/sys/fs/cgroup/cpu,cpuacct", func(path string, info os.FileInfo, err error) error {
+	root := sysFilePath("fs/cgroup/cpu,cpuacct")
+	err = m.fs().Walk(root, func(path string, info os.FileInfo, err error) error {
 		if info != nil && info.Name() == "cpuacct.usage_percpu" {
-			t := filepath.Dir(path[27:])
+			rel, _ := filepath.Rel(root, path)
+			t := filepath.Dir(rel)
 			if t != "." {
-				lbl := ""
+				lbl := Labels{"cgroup": t}
 				if strings.HasPrefix(t, "docker/") {
 					docker_id := strings.TrimSuffix(t[7:], ".scope")
-					if docker_labels[docker_id] != "" {
-						lbl = "," + docker_labels[docker_id]
-					}
+					lbl = lbl.With(m.dockerLabels(docker_id))
 				} else if strings.HasPrefix(t, "system.slice/docker-") {
 					docker_id := strings.TrimSuffix(t[20:], ".scope")
-					if docker_labels[docker_id] != "" {
-						lbl = "," + docker_labels[docker_id]
-					}
+					lbl = lbl.With(m.dockerLabels(docker_id))
 				}
 				if strings.HasPrefix(t, "system.slice/") && strings.HasSuffix(t, ".service") {
 					service_id := t[13 : len(t)-8]
-					service_list[service_id] = struct{}{}
-					lbl = fmt.Sprintf("%s,service=\"%s\"", lbl, service_id)
+					m.addService(service_id)
+					lbl["service"] = service_id
 				}
 
 				s, _ = m.ReadFile(path)
@@ -861,16 +993,16 @@ func (m *Metrics) CollectStat() error {
 						n, _ := strconv.ParseInt(usage, 10, 64)
 						total = total + n
 						m.PrintType(fmt.Sprintf("node_cgroup_cpu_core_seconds"), "gauge", "")
-						m.PrintStr(fmt.Sprintf("cgroup=\"%s\",core=\"%d\"%s", t, icore, lbl), fmt.Sprintf("%d.%09d", n/1e9, n%1e9))
+						m.PrintStr(lbl.With(Labels{"core": strconv.Itoa(icore)}), fmt.Sprintf("%d.%09d", n/1e9, n%1e9))
 					}
 					m.PrintType(fmt.Sprintf("node_cgroup_cpu_seconds"), "gauge", "")
-					m.PrintStr(fmt.Sprintf("cgroup=\"%s\"%s", t, lbl), fmt.Sprintf("%d.%09d", total/1e9, total%1e9))
+					m.PrintStr(lbl, fmt.Sprintf("%d.%09d", total/1e9, total%1e9))
 				}
 
-				s, err := m.ReadFile("/sys/fs/cgroup/cpu,cpuacct/" + t + "/cpu.shares")
+				s, err := m.ReadFile(filepath.Join(root, t, "cpu.shares"))
 				if err == nil {
 					m.PrintType(fmt.Sprintf("node_cgroup_cpu_shares"), "gauge", "")
-					m.PrintStr(fmt.Sprintf("cgroup=\"%s\"%s", t, lbl), strings.TrimSpace(s))
+					m.PrintStr(lbl, strings.TrimSpace(s))
 				}
 			}
 		}
@@ -880,25 +1012,17 @@ func (m *Metrics) CollectStat() error {
 	return err
 }
 
-func (m *Metrics) CollectNetdev(pid int64, subLabel string) error {
-	if subLabel != "" {
-		subLabel = "," + subLabel
-	}
+func (m *Metrics) CollectNetdev(pid int64, subLabel Labels) error {
 	s := ""
 	var err error
 	if pid == 0 {
-		s, err = m.ReadFile("/proc/net/dev")
+		s, err = m.ReadFile(procFilePath("net/dev"))
 	} else {
-		s, err = m.ReadFile(fmt.Sprintf("/proc/%d/net/dev", pid))
+		s, err = m.ReadFile(procFilePath(fmt.Sprintf("%d/net/dev", pid)))
 	}
 	hs, kv := (ProcFile{Text: s, Sep: ":", SkipRows: 2}).KV()
 
-	virt_devs := []string{}
-	virt_dir, err := os.Open("/sys/devices/virtual/net/")
-	if err == nil {
-		defer virt_dir.Close()
-		virt_devs, err = virt_dir.Readdirnames(0)
-	}
+	virt_devs, _ := m.fs().ReadDir(sysFilePath("devices/virtual/net"))
 
 	if len(hs) != 2 {
 		return nil
@@ -909,7 +1033,8 @@ func (m *Metrics) CollectNetdev(pid int64, subLabel string) error {
 	tfaces := split(strings.TrimSpace(faces[2]), -1)
 
 	metrics := make(map[string][]string)
-	for key, value := range kv {
+	for _, key := range sortedKeys(kv) {
+		value := kv[key]
 		metrics[key] = split(value, -1)
 	}
 
@@ -926,7 +1051,8 @@ func (m *Metrics) CollectNetdev(pid int64, subLabel string) error {
 		m.PrintType(fmt.Sprintf("node_network_%s_%s", inter, face), "gauge", "")
 
 	interface_loop:
-		for key, values := range metrics {
+		for _, key := range sortedKeys(metrics) {
+			values := metrics[key]
 
 			for _, virt := range virt_devs {
 				if key == virt {
@@ -937,15 +1063,25 @@ func (m *Metrics) CollectNetdev(pid int64, subLabel string) error {
 			if err != nil {
 				continue
 			}
-			m.PrintInt(fmt.Sprintf("device=\"%s\"%s", key, subLabel), n)
+			m.PrintInt(Labels{"device": key}.With(subLabel), n)
 		}
 	}
 
 	return err
 }
 
+// CollectNetdevAll reports the host interfaces followed by those inside each
+// running docker container.
+func (m *Metrics) CollectNetdevAll() error {
+	err := m.CollectNetdev(0, nil)
+	for _, d := range m.sortedDockers() {
+		m.CollectNetdev(int64(d.State.Pid), m.dockerLabels(d.ID))
+	}
+	return err
+}
+
 func (m *Metrics) CollectArp() error {
-	s, err := m.ReadFile("/proc/net/arp")
+	s, err := m.ReadFile(procFilePath("net/arp"))
 	if err != nil {
 		return err
 	}
@@ -964,15 +1100,16 @@ func (m *Metrics) CollectArp() error {
 	}
 
 	m.PrintType("node_arp_entries", "gauge", "ARP entries by device")
-	for key, value := range devices {
-		m.PrintInt(fmt.Sprintf("device=\"%s\"", key), value)
+	for _, key := range sortedKeys(devices) {
+		value := devices[key]
+		m.PrintInt(Labels{"device": key}, value)
 	}
 
 	return err
 }
 
 func (m *Metrics) CollectEntropy() error {
-	s, err := m.ReadFile("/proc/sys/kernel/random/entropy_avail")
+	s, err := m.ReadFile(procFilePath("sys/kernel/random/entropy_avail"))
 	if err != nil {
 		return err
 	}
@@ -983,28 +1120,28 @@ func (m *Metrics) CollectEntropy() error {
 	}
 
 	m.PrintType("node_entropy_available_bits", "gauge", "Bits of available entropy")
-	m.PrintInt("", n)
+	m.PrintInt(nil, n)
 
 	return err
 }
 
 func (m *Metrics) CollectThreads() error {
-	s, err := m.ReadFile("/proc/sys/kernel/threads-max")
+	s, err := m.ReadFile(procFilePath("sys/kernel/threads-max"))
 	if err == nil {
 		m.PrintType("node_procs_threads_maximum", "gauge", "Maximum threads")
-		m.PrintStr("", strings.TrimSpace(s))
+		m.PrintStr(nil, strings.TrimSpace(s))
 	}
 
-	s, err = m.ReadFile("/proc/sys/vm/max_map_count")
+	s, err = m.ReadFile(procFilePath("sys/vm/max_map_count"))
 	if err == nil {
 		m.PrintType("node_procs_map_count_maximum", "gauge", "Maximum number of memory map areas a process may have")
-		m.PrintStr("", strings.TrimSpace(s))
+		m.PrintStr(nil, strings.TrimSpace(s))
 	}
 
-	s, err = m.ReadFile("/proc/sys/kernel/pid_max")
+	s, err = m.ReadFile(procFilePath("sys/kernel/pid_max"))
 	if err == nil {
 		m.PrintType("node_procs_pid_maximum", "gauge", "Maximum threads")
-		m.PrintStr("", strings.TrimSpace(s))
+		m.PrintStr(nil, strings.TrimSpace(s))
 	}
 
 	return err
@@ -1025,13 +1162,17 @@ var DiskStatsMode []string = []string{
 }
 
 func (m *Metrics) CollectDiskstats() error {
-	s, err := m.ReadFile("/proc/diskstats")
+	s, err := m.ReadFile(procFilePath("diskstats"))
 	if err != nil {
 		return err
 	}
 
 	scanner := bufio.NewScanner(strings.NewReader(s))
 
+	// The device mapper names, and the names of the devices by number for the
+	// blkio cgroup files
+	dms := make(map[string]string)
+	blk_dev := make(map[string]string)
 	devices := make(map[string][]string)
 	for scanner.Scan() {
 		parts := split(strings.TrimSpace(scanner.Text()), -1)
@@ -1043,7 +1184,7 @@ func (m *Metrics) CollectDiskstats() error {
 		//fmt.Println("dev", dev, dev[0:2])
 		if len(dev) > 3 && dev[0:3] == "dm-" {
 			if dms[dev] == "" {
-				dm_s, err := m.ReadFile(fmt.Sprintf("/sys/block/%s/dm/name", dev))
+				dm_s, err := m.ReadFile(sysFilePath(fmt.Sprintf("block/%s/dm/name", dev)))
 				if err == nil {
 					t := strings.TrimSpace(dm_s)
 					dms[dev] = t
@@ -1061,41 +1202,40 @@ func (m *Metrics) CollectDiskstats() error {
 
 	for i, mode := range DiskStatsMode {
 		m.PrintType(fmt.Sprintf("node_disk_%s", mode), "gauge", "")
-		for dev, values := range devices {
+		for _, dev := range sortedKeys(devices) {
+			values := devices[dev]
 			n, err := strconv.ParseInt(values[i], 10, 64)
 			if err != nil {
 				continue
 			}
-			m.PrintInt(fmt.Sprintf("device=\"%s\"", dev), n)
+			m.PrintInt(Labels{"device": dev}, n)
 		}
 	}
 
 	//fmt.Println("readdir", findDirs("/sys/fs/cgroup/blkio", "blkio.throttle.io_serviced"))
 
-	err = filepath.Walk("/sys/fs/cgroup/blkio", func(path string, info os.FileInfo, err error) error {
+	root := sysFilePath("fs/cgroup/blkio")
+	err = m.fs().Walk(root, func(path string, info os.FileInfo, err error) error {
 		if info != nil && info.Name() == "blkio.throttle.io_serviced" {
-			t := filepath.Dir(path[21:])
+			rel, _ := filepath.Rel(root, path)
+			t := filepath.Dir(rel)
 			if t != "." {
-				lbl := ""
+				lbl := Labels{"cgroup": t}
 				if strings.HasPrefix(t, "docker/") {
 					docker_id := strings.TrimSuffix(t[7:], ".scope")
-					if docker_labels[docker_id] != "" {
-						lbl = "," + docker_labels[docker_id]
-					}
+					lbl = lbl.With(m.dockerLabels(docker_id))
 				} else if strings.HasPrefix(t, "system.slice/docker-") {
 					docker_id := strings.TrimSuffix(t[20:], ".scope")
-					if docker_labels[docker_id] != "" {
-						lbl = "," + docker_labels[docker_id]
-					}
+					lbl = lbl.With(m.dockerLabels(docker_id))
 				}
 				if strings.HasPrefix(t, "system.slice/") && strings.HasSuffix(t, ".service") {
 					service_id := t[13 : len(t)-8]
-					lbl = fmt.Sprintf("%s,service=\"%s\"", lbl, service_id)
+					lbl["service"] = service_id
 				}
 
 				s_files := [2]string{}
 				s_files[0], _ = m.ReadFile(path)
-				s_files[1], _ = m.ReadFile("/sys/fs/cgroup/blkio/" + t + "/blkio.throttle.io_service_bytes")
+				s_files[1], _ = m.ReadFile(filepath.Join(root, t, "blkio.throttle.io_service_bytes"))
 				for i, s := range s_files {
 					ty := ""
 					if i == 1 {
@@ -1113,10 +1253,10 @@ func (m *Metrics) CollectDiskstats() error {
 								parts[0] = tdev
 							}
 							m.PrintType(fmt.Sprintf("node_cgroup_blkio_%s%s", parts[1], ty), "gauge", "")
-							m.PrintStr(fmt.Sprintf("device=\"%s\",cgroup=\"%s\"%s", parts[0], t, lbl), parts[2])
+							m.PrintStr(lbl.With(Labels{"device": parts[0]}), parts[2])
 						} else if len(parts) == 2 {
 							m.PrintType(fmt.Sprintf("node_cgroup_blkio_%s%s", parts[0], ty), "gauge", "")
-							m.PrintStr(fmt.Sprintf("cgroup=\"%s\"%s", t, lbl), parts[1])
+							m.PrintStr(lbl, parts[1])
 						}
 					}
 				}
@@ -1129,7 +1269,7 @@ func (m *Metrics) CollectDiskstats() error {
 }
 
 func (m *Metrics) CollectMDStat() error {
-	_, err := m.ReadFile("/tmp/proc/mdstat")
+	_, err := m.ReadFile(rootfsFilePath("tmp/proc/mdstat"))
 	if err != nil {
 		return err
 	}
@@ -1163,8 +1303,37 @@ type FilesystemInfo struct {
 	FilesUsed  int64
 }
 
+func (fi FilesystemInfo) Labels() Labels {
+	return Labels{"device": fi.Device, "fstype": fi.FSType, "mountpoint": fi.MountPoint}
+}
+
+// unescapeMount decodes the octal escapes (\040 for a space, \011 for a tab,
+// \012 for a newline and \134 for a backslash) used in /proc/mounts.
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
 func (m *Metrics) CollectFilesystem() error {
-	s, err := m.ReadFile("/proc/mounts")
+	// The mount table of pid 1 is the host's, even when running in a container
+	// with the host /proc mounted on --path.procfs.
+	s, err := m.ReadFile(procFilePath("1/mounts"))
+	if err != nil {
+		s, err = m.ReadFile(procFilePath("mounts"))
+	}
 	if err != nil {
 		return err
 	}
@@ -1174,7 +1343,10 @@ func (m *Metrics) CollectFilesystem() error {
 	scanner := bufio.NewScanner(strings.NewReader(s))
 	for scanner.Scan() {
 		parts := split(strings.TrimSpace(scanner.Text()), -1)
-		device, mountpoint, fstype, flags := parts[0], parts[1], parts[2], parts[3]
+		if len(parts) < 4 {
+			continue
+		}
+		device, mountpoint, fstype, flags := unescapeMount(parts[0]), rootfsStripPrefix(unescapeMount(parts[1])), parts[2], parts[3]
 
 		if regexp.MustCompile(defIgnoredMountPoints).MatchString(mountpoint) {
 			continue
@@ -1200,6 +1372,11 @@ func (m *Metrics) CollectFilesystem() error {
 		}
 	}
 
+	filesystems := []FilesystemInfo{}
+	for _, mountpoint := range sortedKeys(mountpoints) {
+		filesystems = append(filesystems, mountpoints[mountpoint])
+	}
+
 	/*
 			cmd := "df"
 			if m.Client.hasTimeout {
@@ -1262,274 +1439,177 @@ func (m *Metrics) CollectFilesystem() error {
 
 	*/
 	// "--all", "--sync",
-	out, err := exec.Command("df", "--block-size=1024", "--output=source,target,fstype,itotal,iavail,iused,size,avail,used").Output()
-	if err == nil {
-
-		scanner = bufio.NewScanner(strings.NewReader(string(out)))
-		for scanner.Scan() {
-			parts := split(strings.TrimSpace(scanner.Text()), -1)
-			if parts[0] == "Filesystem" {
-				continue
-			}
-			fi, ok := mountpoints[parts[1]]
-
-			if ok {
-				//fmt.Println("found ", parts)
-				fi.FSType = parts[2]
-				fi.Files, err = strconv.ParseInt(parts[3], 10, 64)
-				fi.FilesFree, err = strconv.ParseInt(parts[4], 10, 64)
-				fi.FilesUsed, err = strconv.ParseInt(parts[5], 10, 64)
-				fi.Size, err = strconv.ParseInt(parts[6], 10, 64)
-				fi.Avail, err = strconv.ParseInt(parts[7], 10, 64)
-				fi.Used, err = strconv.ParseInt(parts[8], 10, 64)
-				mountpoints[parts[1]] = fi
-			}
+	out, err := m.Command("df", "--block-size=1024", "--output=source,target,fstype,itotal,iavail,iused,size,avail,used")
+	if err != nil {
+		return fmt.Errorf("df: %v", err)
+	}
 
+	scanner = bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		parts := split(strings.TrimSpace(scanner.Text()), -1)
+		if len(parts) < 9 || parts[0] == "Filesystem" {
+			continue
+		}
+		// df prints the target as is, so take the columns after it from
+		// the right in case it has a space
+		n := len(parts) - 7
+		target := strings.Join(parts[1:n], " ")
+		if !inRootfs(target) {
+			continue
+		}
+		mountpoint := rootfsStripPrefix(target)
+		fi, ok := mountpoints[mountpoint]
+
+		if ok {
+			//fmt.Println("found ", parts)
+			fi.FSType = parts[n]
+			fi.Files, err = strconv.ParseInt(parts[n+1], 10, 64)
+			fi.FilesFree, err = strconv.ParseInt(parts[n+2], 10, 64)
+			fi.FilesUsed, err = strconv.ParseInt(parts[n+3], 10, 64)
+			fi.Size, err = strconv.ParseInt(parts[n+4], 10, 64)
+			fi.Avail, err = strconv.ParseInt(parts[n+5], 10, 64)
+			fi.Used, err = strconv.ParseInt(parts[n+6], 10, 64)
+			mountpoints[mountpoint] = fi
 		}
 
-		m.PrintType("node_filesystem_size", "gauge", "Filesystem size in bytes")
-		for _, fi := range mountpoints {
-			if fi.Size > 0 {
-				m.PrintInt(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.Size)
-			}
+	}
+
+	filesystems = filesystems[:0]
+	for _, mountpoint := range sortedKeys(mountpoints) {
+		filesystems = append(filesystems, mountpoints[mountpoint])
+	}
+
+	m.PrintType("node_filesystem_size", "gauge", "Filesystem size in bytes")
+	for _, fi := range filesystems {
+		if fi.Size > 0 {
+			m.PrintInt(fi.Labels(), fi.Size)
 		}
+	}
 
-		m.PrintType("node_filesystem_free", "gauge", "Filesystem free space in bytes")
-		for _, fi := range mountpoints {
-			if fi.Size > 0 {
-				m.PrintInt(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.Size-fi.Used)
-			}
+	m.PrintType("node_filesystem_free", "gauge", "Filesystem free space in bytes")
+	for _, fi := range filesystems {
+		if fi.Size > 0 {
+			m.PrintInt(fi.Labels(), fi.Size-fi.Used)
 		}
+	}
 
-		m.PrintType("node_filesystem_avail", "gauge", "Filesystem space available to non-root users in bytes")
-		for _, fi := range mountpoints {
-			if fi.Size > 0 {
-				m.PrintInt(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.Avail)
-			}
+	m.PrintType("node_filesystem_avail", "gauge", "Filesystem space available to non-root users in bytes")
+	for _, fi := range filesystems {
+		if fi.Size > 0 {
+			m.PrintInt(fi.Labels(), fi.Avail)
 		}
+	}
 
-		m.PrintType("node_filesystem_files", "gauge", "Filesystem inodes number")
-		for _, fi := range mountpoints {
-			if fi.Size > 0 {
-				m.PrintInt(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.Files)
-			}
+	m.PrintType("node_filesystem_files", "gauge", "Filesystem inodes number")
+	for _, fi := range filesystems {
+		if fi.Size > 0 {
+			m.PrintInt(fi.Labels(), fi.Files)
 		}
+	}
 
-		m.PrintType("node_filesystem_files_free", "gauge", "Filesystem inodes free number")
-		for _, fi := range mountpoints {
-			if fi.Size > 0 {
-				m.PrintInt(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.FilesFree)
-			}
+	m.PrintType("node_filesystem_files_free", "gauge", "Filesystem inodes free number")
+	for _, fi := range filesystems {
+		if fi.Size > 0 {
+			m.PrintInt(fi.Labels(), fi.FilesFree)
 		}
 	}
 
 	m.PrintType("node_filesystem_readonly", "gauge", "Filesystem readonly")
-	for _, fi := range mountpoints {
+	for _, fi := range filesystems {
 		if fi.Size > 0 {
-			m.PrintBool(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.ReadOnly)
+			m.PrintBool(fi.Labels(), fi.ReadOnly)
 		}
 	}
 
 	return nil
 }
 
-/*func (m *Metrics) CollectTextfile() error {
-	for _, name := range m.Files() {
-		if !strings.HasPrefix(name, TextfilePath) {
-			continue
-		}
-		s, err := m.ReadFile(name)
-		if err != nil {
-			return err
+// CollectAll runs the collectors and renders what they collected.  It fails
+// only when every collector did, as when the host cannot be reached, so
+// there is nothing to show.
+func (m *Metrics) CollectAll() (string, error) {
+	// One deadline for the whole scrape, so the pre-read and the collectors
+	// waiting on others cannot add up to more
+	ctx, cancel := context.WithTimeout(m.context(), scrapeTimeout())
+	defer cancel()
+	saved := m.ctx
+	m.ctx = ctx
+	defer func() { m.ctx = saved }()
+
+	if m.Client != nil && m.FS == nil {
+		if err := m.PreRead(); err != nil {
+			log.Printf("%T.PreRead() error: %+v\n", m, err)
 		}
-		m.PrintRaw(string(s))
 	}
-	return nil
-}*/
-
-func (m *Metrics) CollectScript() error {
-	cmd := fmt.Sprintf("echo %s | base64 -d | gunzip | sh", m.Client.script)
-	output, _ := m.Client.Execute(cmd)
-	m.PrintRaw(output)
-	return nil
-}
 
-func (m *Metrics) CollectAll() (string, error) {
-	//var err error
-
-	//err = m.PreRead()
-	//if err != nil {
-	//	log.Printf("%T.PreRead() error: %+v\n", m, err)
-	//}
-
-	getDocker() // This needs to be called early because it is used for later routines
-
-	//m.CollectTime()
-	m.CollectLoadavg()
-	m.CollectFilefd()
-	m.CollectNfConntrack()
-	m.CollectNetstat()
-	m.CollectSockstat()
-	m.CollectVmstat()
-	m.CollectArp()
-	m.CollectEntropy()
-	m.CollectThreads()
-
-	m.CollectNetdev(0, "")
-	for _, d := range Dockers {
-		//fmt.Println("docker", d)
-		t := fmt.Sprintf("docker_name=\"%s\",docker_image=\"%s\"", d.Name, d.Image)
-		m.CollectNetdev(int64(d.State.Pid), t)
-		docker_labels[d.ID] = t
-	}
-
-	m.PrintType("node_docker_started_at", "gauge", "Docker created time")
-	for _, d := range Dockers {
-		if strings.HasPrefix(d.State.StartedAt, "000") {
-			continue
+	results := m.runCollectors()
+	var failed int
+	var last error
+	for _, r := range results {
+		if r.err != nil {
+			log.Printf("collector %s failed after %v: %v", r.collector.Name, r.duration, r.err)
+			failed, last = failed+1, r.err
 		}
-		if t, err := dateparse.ParseAny(d.State.StartedAt); err == nil {
-			m.PrintInt(docker_labels[d.ID], t.UnixNano()/1e6)
-		} else {
-			//m.PrintStr(docker_labels[d.ID], "NaN")
+		if r.metrics != nil {
+			m.merge(r.metrics)
 		}
-	}
 
-	m.PrintType("node_docker_finished_at", "gauge", "Docker finished time")
-	for _, d := range Dockers {
-		if strings.HasPrefix(d.State.FinishedAt, "000") {
+		if m.NoScrapeFamilies {
 			continue
 		}
-		if t, err := dateparse.ParseAny(d.State.FinishedAt); err == nil {
-			m.PrintInt(docker_labels[d.ID], t.UnixNano()/1e6)
-		} else {
-			//m.PrintStr(docker_labels[d.ID], "NaN")
-		}
+		m.PrintType("node_scrape_collector_duration_seconds", "gauge", "Duration of a collector scrape")
+		m.PrintFloat(Labels{"collector": r.collector.Name}, r.duration.Seconds())
+		m.PrintType("node_scrape_collector_success", "gauge", "Whether a collector succeeded")
+		m.PrintBool(Labels{"collector": r.collector.Name}, r.err == nil)
 	}
 
-	m.PrintType("node_docker_info", "gauge", "Docker info")
-	for _, d := range Dockers {
-		/*
-			lblarr := make(map[string]string)
-			for l, v := range d.Labels {
-				lblarr[strings.ToLower(l)] = v
-			}
-			lblstr := []string{docker_labels[d.ID]}
-			reg, _ := regexp.Compile("[^a-zA-Z0-9_]+")
-			for l, v := range lblarr {
-				lblstr = append(lblstr, fmt.Sprintf("%s=%q", reg.ReplaceAllString(l, "_"), v))
-			}
-			m.PrintInt(strings.Join(lblstr, ","), 1)
-		*/
-		m.PrintInt(fmt.Sprintf("%s,processLabel=%q,mountLabel=%q", docker_labels[d.ID], d.ProcessLabel, d.MountLabel), 1)
+	if failed > 0 && failed == len(results) {
+		return "", fmt.Errorf("all %d collectors failed, the last with: %v", failed, last)
 	}
+	return m.String(), nil
+}
 
-	m.PrintType("node_docker_running", "gauge", "Docker container is running")
-	for _, d := range Dockers {
-		m.PrintBool(docker_labels[d.ID], d.State.Running)
-	}
-	m.PrintType("node_docker_restarting", "gauge", "Docker container is running")
-	for _, d := range Dockers {
-		m.PrintBool(docker_labels[d.ID], d.State.Restarting)
-	}
-	m.PrintType("node_docker_restart_count", "gauge", "Docker restart count")
-	for _, d := range Dockers {
-		m.PrintInt(docker_labels[d.ID], int64(d.RestartCount))
-	}
-	m.PrintType("node_docker_size_rw", "gauge", "Docker container size RW")
-	for _, d := range Dockers {
-		if d.SizeRw != nil {
-			m.PrintInt(docker_labels[d.ID], *d.SizeRw)
-		}
-	}
-	m.PrintType("node_docker_size_root", "gauge", "Docker container size Root")
-	for _, d := range Dockers {
-		if d.SizeRootFs != nil {
-			m.PrintInt(docker_labels[d.ID], *d.SizeRootFs)
+// labelsFlag registers a repeatable NAME=VALUE flag filling the labels.
+func labelsFlag(name, usage string) Labels {
+	labels := Labels{}
+	params.FlagFunc(name, usage, "NAME=VALUE", 1, func(v []string) error {
+		n, value, ok := strings.Cut(v[0], "=")
+		if !ok || !validLabelName(n) {
+			return fmt.Errorf("expected NAME=VALUE, got %q", v[0])
 		}
-	}
-
-	/*
-	   type Docker struct {
-	     Id      string
-	     Names   []string
-	     Image   string
-	     Created int64
-	     State   string
-	     Labels  map[string]string
-	     cont    Container
-	   }
-	   type ContainerState struct {
-	     Status     string
-	     Running    bool
-	     Paused     bool
-	     Restarting bool
-	     OOMKilled  bool
-	     Pid        int64
-	     StartedAt  time.Time
-	     FinishedAt time.Time
-	   }
-	   type Container struct {
-	     State        ContainerState
-	     LogPath      string
-	     Name         string
-	     RestartCount int64
-	   }
-	*/
-
-	m.CollectNFTables()
-
-	m.CollectDiskstats()
-	//m.CollectMDStat()
-	m.CollectStat()
-	m.CollectMemory()
-	m.CollectSystemd()
-	m.CollectKernel()
-	m.CollectFilesystem()
-	//m.CollectTextfile()
-	//m.CollectScript()
-
-	//ens192, _ := netlink.LinkByName("vethcc9bdbc")
-	//Qdisc, _ := netlink.QdiscList(ens192)
-	//fmt.Println("qd: ", Qdisc)
-
-	return m.body.String(), nil
+		labels[n] = value
+		return nil
+	})
+	return labels
 }
 
-/*func Forward(lconn net.Conn) {
-	addr := net.JoinHostPort(SshHost, SshPort)
-	config := &ssh.ClientConfig{
-		User: SshUser,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(SshPass),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         8 * time.Second,
-	}
-
-	c, err := ssh.Dial("tcp", addr, config)
-	if err != nil {
-		log.Printf("ssh.Dial(%#v) error: %+v\n", addr, err)
-		return
+// argvSize is the space the kernel handed us for the command line, which is
+// all SetProcessName may write over.
+var argvSize = func() (n int) {
+	for _, a := range os.Args {
+		n += len(a) + 1
 	}
+	return
+}()
 
-	rconn, err := c.Dial("tcp", RemoteAddr)
-	if err != nil {
-		log.Printf("%T.Dial(%#v) error: %+v\n", RemoteAddr, err)
-		return
+func init() {
+	// SetProcessName reuses the argv memory, so detach the arguments to keep
+	// the parsed parameters from being clobbered.
+	for i := 1; i < len(os.Args); i++ {
+		os.Args[i] = strings.Clone(os.Args[i])
 	}
-
-	go io.Copy(rconn, lconn)
-	io.Copy(lconn, rconn)
-}*/
+}
 
 func SetProcessName(name string) error {
 	if runtime.GOOS == "linux" {
+		if len(name) >= argvSize {
+			name = name[:argvSize-1]
+		}
 		argv0str := (*reflect.StringHeader)(unsafe.Pointer(&os.Args[0]))
-		argv0 := (*[1 << 30]byte)(unsafe.Pointer(argv0str.Data))[:len(name)+1]
+		argv0 := (*[1 << 30]byte)(unsafe.Pointer(argv0str.Data))[:argvSize]
 
-		n := copy(argv0, name+"\x00")
-		if n < len(argv0) {
+		n := copy(argv0, name)
+		for ; n < len(argv0); n++ {
 			argv0[n] = 0
 		}
 	}
@@ -1542,220 +1622,268 @@ var version = "0"
 func main() {
 	params.CommandLine.Title = "node-stats, a prometheus metrics collector, Written by Paul Schou (github.com/pschou/node-stats), Version: " + version
 	includeTime := params.Pres("time", "Include time in output")
+	listen := params.String("listen", "", "Serve metrics over HTTP on this address instead of printing them once", "ADDR")
+	metricsPath := params.String("metrics.path", "/metrics", "Path under which to expose metrics when listening", "PATH")
+	format := params.String("format", FormatPrometheus, "Output format: prometheus, openmetrics, influx line protocol, graphite plaintext, json, ndjson or protobuf (HTTP scrapers may negotiate OpenMetrics or protobuf)", "FORMAT")
+	interval := params.Duration("interval", 0, "Collect and print again on this interval instead of once, as with --format=ndjson to stream a line a collection", "DURATION")
+	outputFile := params.String("output.file", "", "Write the metrics to this file instead of printing them, replacing it whole each --interval, as for the node_exporter textfile collector (runs only the collectors named with --collector.<name>, in the prometheus format without --time)", "FILE")
+	outputMaxAge := params.Duration("output.max-age", 0, "Remove the output file when nothing could be written to it for this long (default three intervals)", "DURATION")
+	params.StringVar(&compatMode, "compat", compatMode, "Metric naming mode, node_exporter for upstream compatible names, types and units", "MODE")
+	listCollectors := params.Pres("collectors.list", "List the available collectors and exit")
+	params.StringVar(&procPath, "path.procfs", procPath, "procfs mountpoint", "PATH")
+	params.StringVar(&sysPath, "path.sysfs", sysPath, "sysfs mountpoint", "PATH")
+	params.StringVar(&rootfsPath, "path.rootfs", rootfsPath, "Host root filesystem mountpoint", "PATH")
+	params.GroupingSet("SSH")
+	sshHost := params.String("ssh.host", os.Getenv("SSH_HOST"), "Collect from this host over SSH instead of the local one (env SSH_HOST)", "HOST")
+	sshPort := params.String("ssh.port", envDefault("SSH_PORT", "22"), "SSH port (env SSH_PORT)", "PORT")
+	sshUser := params.String("ssh.user", os.Getenv("SSH_USER"), "SSH user (env SSH_USER)", "USER")
+	sshKey := params.String("ssh.key", os.Getenv("SSH_KEY"), "SSH private key file, which may be encrypted (env SSH_KEY, passphrase from env SSH_KEY_PASSPHRASE)", "FILE")
+	sshCert := params.String("ssh.cert", os.Getenv("SSH_CERT"), "SSH certificate for the key, defaults to the -cert.pub file next to it (env SSH_CERT)", "FILE")
+	params.StringVar(&knownHostsFile, "ssh.known-hosts", envDefault("SSH_KNOWN_HOSTS", knownHostsFile), "File of known host keys (env SSH_KNOWN_HOSTS)", "FILE")
+	params.StringVar(&hostKeyCheck, "ssh.host-key-check", hostKeyCheck, "Host key checking: yes, accept-new to trust and record keys of new hosts, or no", "MODE")
+	configFile := params.String("config.file", "", "YAML file of SSH targets to serve on /probe?target=NAME and tunnels to forward", "FILE")
+	params.GroupingSet("")
+	params.GroupingSet("Push")
+	pushURL := params.String("push.url", os.Getenv("PUSH_URL"), "Push the metrics to this Pushgateway on an interval instead of printing them (env PUSH_URL)", "URL")
+	pushJob := params.String("push.job", "node", "Job label to push under", "NAME")
+	pushInstance := params.String("push.instance", "", "Instance label to push under (default the SSH host or hostname)", "NAME")
+	pushGrouping := labelsFlag("push.grouping", "Another label to push under (may be repeated)")
+	pushUser := params.String("push.user", os.Getenv("PUSH_USER"), "Basic auth user, the password is taken from env PUSH_PASSWORD (env PUSH_USER)", "USER")
+	pushInterval := params.Duration("push.interval", 15*time.Second, "Time between pushes", "DURATION")
+	pushRetries := params.Int("push.retries", 3, "Times to retry a push which failed", "COUNT")
+	params.GroupingSet("")
+	params.GroupingSet("Remote write")
+	writeURL := params.String("remote-write.url", os.Getenv("REMOTE_WRITE_URL"), "Send the metrics to this Prometheus remote_write endpoint on an interval (env REMOTE_WRITE_URL)", "URL")
+	writeInterval := params.Duration("remote-write.interval", 15*time.Second, "Time between collections", "DURATION")
+	writeDir := params.String("remote-write.queue.dir", filepath.Join(os.TempDir(), "node-stats-remote-write"), "Directory queueing the collections not yet sent, best on persistent storage", "DIR")
+	writeMax := params.Int("remote-write.queue.max-bytes", 64<<20, "Size of the queue past which the oldest collections are dropped", "BYTES")
+	writeUser := params.String("remote-write.user", os.Getenv("REMOTE_WRITE_USER"), "Basic auth user, the password is taken from env REMOTE_WRITE_PASSWORD (env REMOTE_WRITE_USER)", "USER")
+	writeLabels := labelsFlag("remote-write.label", "Label added to every series, job=node and instance=HOST unless given (may be repeated)")
+	params.GroupingSet("")
+	params.GroupingSet("Graphite")
+	params.FlagFunc("graphite.template", "Path of the families matching a glob, as node_cpu_seconds_total=node.{host}.cpu.{cpu}.{mode} (may be repeated, the first match is used)", "FAMILY=TEMPLATE", 1, func(v []string) error {
+		t, err := parseGraphiteTemplate(v[0])
+		if err != nil {
+			return err
+		}
+		graphiteTemplates = append(graphiteTemplates, t)
+		return nil
+	})
+	carbonAddr := params.String("carbon.addr", os.Getenv("CARBON_ADDR"), "Send the metrics in the graphite format to this Carbon plaintext listener on an interval (env CARBON_ADDR)", "HOST:PORT")
+	carbonInterval := params.Duration("carbon.interval", 15*time.Second, "Time between sends", "DURATION")
+	params.GroupingSet("")
+	params.GroupingSet("OpenTelemetry")
+	otlpURL := params.String("otlp.endpoint", envDefault("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")), "Export the metrics to this OTLP/HTTP collector on an interval, /v1/metrics is added to a bare URL (env OTEL_EXPORTER_OTLP_METRICS_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT)", "URL")
+	otlpHeaders := map[string]string{}
+	if err := parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), otlpHeaders); err != nil {
+		log.Fatalf("OTEL_EXPORTER_OTLP_HEADERS: %v", err)
+	}
+	params.FlagFunc("otlp.header", "Header sent with each export, such as an API key (may be repeated, env OTEL_EXPORTER_OTLP_HEADERS)", "KEY=VALUE", 1, func(v []string) error {
+		return parseOTLPHeaders(v[0], otlpHeaders)
+	})
+	otlpInterval := params.Duration("otlp.interval", 15*time.Second, "Time between exports", "DURATION")
+	params.GroupingSet("")
+	CollectorFlags()
 	params.Parse()
 
-	if *includeTime {
-		msec = fmt.Sprintf(" %d", time.Now().UnixNano()/1e6)
-	}
+	rootfsPath = filepath.Clean(rootfsPath)
 
-	fmt.Println("#ABOUT: NodeStats written by Paul Schou -- https://github.com/pschou/node-stats")
-	/*
-		log.AddFlags(kingpin.CommandLine)
-		kingpin.Version(version.Print("remote_node_exporter"))
-		kingpin.HelpFlag.Short('h')
-		kingpin.Parse()
-
-		log.Infoln("Starting remote_node_exporter", version.Info())
-		log.Infoln("Build context", version.BuildContext())
-
-		if SshHost == "" {
-			type Config struct {
-				Exporter []struct {
-					Host   string
-					Port   int
-					User   string
-					Pass   string
-					Key    string
-					Local  int
-					Script string
-				}
-				Forward []struct {
-					Host   string
-					Port   int
-					User   string
-					Pass   string
-					Key    string
-					Local  int
-					Remote string
-				}
-			}
-
-			config := &Config{}
+	// The textfile collector of node_exporter reads extras alongside its own
+	// collectors, and refuses a file with timestamps or which is not plain
+	// Prometheus text
+	if *outputFile != "" {
+		switch {
+		case *includeTime:
+			log.Fatal("--output.file cannot be used with --time, the textfile collector refuses timestamps")
+		case *format != FormatPrometheus:
+			log.Fatal("--output.file writes the prometheus format only, which is what the textfile collector reads")
+		case !ChosenCollectorsOnly():
+			log.Fatal("--output.file needs the collectors to write named with --collector.<name>, as node_exporter has its own for the rest")
+		}
+	}
 
-			exe, err := os.Executable()
-			if err != nil {
-				log.Fatalf("error: %v", err)
-			}
+	if *listCollectors {
+		ListCollectors()
+		return
+	}
 
-			ConfigPaths := []string{
-				*configFile,
-				path.Join(path.Dir(exe), path.Base(*configFile)),
-			}
+	if !validFormat(*format) {
+		log.Fatalf("Unknown output format %q", *format)
+	}
+	if !validCompat(compatMode) {
+		log.Fatalf("Unknown compat mode %q", compatMode)
+	}
+	if !validHostKeyCheck(hostKeyCheck) {
+		log.Fatalf("Unknown host key check %q", hostKeyCheck)
+	}
+	var client *Client
+	if *sshHost != "" {
+		port, err := strconv.Atoi(*sshPort)
+		if err != nil {
+			log.Fatalf("Invalid SSH port %q", *sshPort)
+		}
+		// The secrets are only taken from the environment to keep them out of ps
+		client, err = NewClient(Target{
+			Host:       *sshHost,
+			Port:       port,
+			User:       *sshUser,
+			Pass:       os.Getenv("SSH_PASS"),
+			Key:        *sshKey,
+			Cert:       *sshCert,
+			Passphrase: os.Getenv("SSH_KEY_PASSPHRASE"),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-			var data []byte
-			for _, filename := range ConfigPaths {
-				data, err = ioutil.ReadFile(filename)
-				if err == nil {
-					break
-				}
-			}
-			if err != nil {
-				log.Fatalf("error: read %+v %v", ConfigPaths, err)
+	var targets map[string]*Client
+	var tunnels []*Tunnel
+	if *configFile != "" {
+		config, err := LoadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(config.Exporter) > 0 {
+			if *listen == "" {
+				log.Fatal("--config.file needs --listen to serve the targets on")
 			}
-
-			err = yaml.Unmarshal(data, &config)
-			if err != nil {
-				log.Fatalf("error: %v", err)
+			if targets, err = config.Clients(); err != nil {
+				log.Fatal(err)
 			}
+		}
+		if tunnels, err = config.Tunnels(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, t := range tunnels {
+		log.Printf("Forwarding %s to %s through %s\n", t.Local, t.Remote, t.client.Addr)
+		t.Start()
+	}
 
-			for _, s := range config.Exporter {
-				if s.Host == "" {
-					log.Fatalf("error: %#v host is empty", s)
-				}
-				if s.Port == 0 {
-					s.Port = 22
-				}
-				cmd := exec.Command(exe)
-				cmd.Stdout = os.Stdout
-				cmd.Stderr = os.Stderr
-				cmd.Env = append(os.Environ(),
-					"SSH_HOST="+s.Host,
-					"SSH_PORT="+strconv.Itoa(s.Port),
-					"SSH_USER="+s.User,
-					"SSH_PASS="+s.Pass,
-					"SSH_KEY="+s.Key,
-					"SSH_SCRIPT="+s.Script,
-					"PORT="+strconv.Itoa(s.Local),
-				)
-				go cmd.Run()
-			}
+	// The instance label of pushed and written metrics
+	instance, _ := os.Hostname()
+	if client != nil {
+		instance = *sshHost
+	}
 
-			for _, s := range config.Forward {
-				if s.Host == "" {
-					log.Fatalf("error: %#v host is empty", s)
-				}
-				if s.Port == 0 {
-					s.Port = 22
-				}
-				cmd := exec.Command(exe)
-				cmd.Env = append(os.Environ(),
-					"SSH_HOST="+s.Host,
-					"SSH_PORT="+strconv.Itoa(s.Port),
-					"SSH_USER="+s.User,
-					"SSH_PASS="+s.Pass,
-					"SSH_KEY="+s.Key,
-					"PORT="+strconv.Itoa(s.Local),
-					"REMOTE_ADDR="+s.Remote,
-				)
-				go cmd.Run()
-			}
+	// Modes which run in the background, besides serving, until killed
+	var background []string
+	if len(tunnels) > 0 {
+		background = append(background, fmt.Sprintf("forwarding %d tunnels", len(tunnels)))
+	}
 
-			SetProcessName("remote_node_exporter: master process " + exe)
-			select {}
+	if *pushURL != "" {
+		if *pushJob == "" || *pushInterval <= 0 {
+			log.Fatal("--push.url needs a --push.job and a --push.interval")
 		}
-
-		if SshPort == "" {
-			SshPort = "22"
+		if *pushInstance != "" {
+			instance = *pushInstance
 		}
+		pusher := &Pusher{
+			URL:      *pushURL,
+			Job:      *pushJob,
+			Instance: instance,
+			Grouping: pushGrouping,
+			User:     *pushUser,
+			Password: os.Getenv("PUSH_PASSWORD"),
+			Interval: *pushInterval,
+			Retries:  *pushRetries,
+			Client:   client,
+		}
+		go pusher.Run()
+		background = append(background, "pushing to "+*pushURL)
+	}
 
-		if RemoteAddr != "" {
-			SetProcessName(fmt.Sprintf("remote_node_exporter: [%s@%s] listening %s tunneling remote %s", SshUser, SshHost, Port, RemoteAddr))
-			for {
-				ln, err := net.Listen("tcp", ":"+Port)
-				if err != nil {
-					SetProcessName(fmt.Sprintf("remote_node_exporter: [%s@%s] listening %s error: %+v", SshUser, SshHost, Port, err))
-					select {}
-				}
-
-				for {
-					conn, err := ln.Accept()
-					if err != nil {
-						time.Sleep(100 * time.Millisecond)
-					}
-					go Forward(conn)
-				}
-			}
-			return
+	if *writeURL != "" {
+		if *writeInterval <= 0 {
+			log.Fatal("--remote-write.url needs a --remote-write.interval")
+		}
+		labels := Labels{"job": "node", "instance": instance}.With(writeLabels)
+		writer := &RemoteWriter{
+			URL:      *writeURL,
+			User:     *writeUser,
+			Password: os.Getenv("REMOTE_WRITE_PASSWORD"),
+			Interval: *writeInterval,
+			Dir:      *writeDir,
+			MaxBytes: int64(*writeMax),
+			Labels:   labels,
+			Client:   client,
 		}
+		go writer.Run()
+		background = append(background, "writing to "+*writeURL)
+	}
 
-		client := &Client{
-			Addr: net.JoinHostPort(SshHost, SshPort),
-			Config: &ssh.ClientConfig{
-				User: SshUser,
-				Auth: []ssh.AuthMethod{
-					ssh.Password(SshPass),
-				},
-				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-				Timeout:         8 * time.Second,
-			},
+	if *carbonAddr != "" {
+		if *carbonInterval <= 0 {
+			log.Fatal("--carbon.addr needs a --carbon.interval")
 		}
+		carbon := &Carbon{Addr: *carbonAddr, Interval: *carbonInterval, Client: client}
+		go carbon.Run()
+		background = append(background, "sending to carbon at "+*carbonAddr)
+	}
 
-		if SshKey != "" {
-			key, err := ioutil.ReadFile(SshKey)
-			if err != nil {
-				log.Fatalf("unable to read private key: %v", err)
-			}
+	if *otlpURL != "" {
+		if *otlpInterval <= 0 {
+			log.Fatal("--otlp.endpoint needs a --otlp.interval")
+		}
+		exporter := &OTLPExporter{Endpoint: otlpEndpoint(*otlpURL), Headers: otlpHeaders, Interval: *otlpInterval, Client: client}
+		go exporter.Run()
+		background = append(background, "exporting to "+exporter.Endpoint)
+	}
 
-			// Create the Signer for this private key.
-			signer, err := ssh.ParsePrivateKey(key)
-			if err != nil {
-				log.Fatalf("unable to parse private key: %v", err)
-			}
+	if *listen != "" {
+		log.Fatal(Serve(*listen, *metricsPath, *format, *includeTime, client, targets))
+	}
+	if len(background) > 0 {
+		setTitle("node-stats: " + strings.Join(background, ", "))
+		select {}
+	}
 
-			client.Config.Auth[0] = ssh.PublicKeys(signer)
+	collect := func() (string, error) {
+		m := Metrics{Client: client, Format: *format, NoScrapeFamilies: *outputFile != ""}
+		if *includeTime {
+			m.Timestamp = time.Now().UnixNano() / 1e6
 		}
+		return m.CollectAll()
+	}
 
-		if SshScript != "" {
-			data, err := ioutil.ReadFile(SshScript)
-			if err != nil {
-				log.Fatalf("unable to read private key: %v", err)
+	if *outputFile != "" {
+		w := &FileWriter{File: *outputFile, Interval: *interval, MaxAge: *outputMaxAge, Collect: collect}
+		if *interval <= 0 {
+			if err := w.WriteOnce(); err != nil {
+				log.Fatal(err)
 			}
-
-			var b bytes.Buffer
-			w := gzip.NewWriter(&b)
-			w.Write(data)
-			w.Flush()
-
-			client.script = base64.StdEncoding.EncodeToString(b.Bytes())
+			return
 		}
-	*/
+		if w.MaxAge == 0 {
+			w.MaxAge = 3 * *interval
+		}
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+		setTitle("node-stats: writing " + *outputFile)
+		w.Run(stop)
+		return
+	}
 
-	//http.HandleFunc("/metrics", func(rw http.ResponseWriter, req *http.Request) {
-	m := Metrics{
-		//	Client: client,
+	if *format == FormatPrometheus {
+		fmt.Println("#ABOUT: NodeStats written by Paul Schou -- https://github.com/pschou/node-stats")
 	}
 
-	s, err := m.CollectAll()
-	if err != nil {
-		//	http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+	if *interval <= 0 {
+		s, err := collect()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(s)
 		return
 	}
-	fmt.Println(s)
-
-	/*if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
-		rw.Header().Set("Content-Encoding", "gzip")
-		rw.Header().Set("Content-Type", "text/plain")
-		rw.WriteHeader(http.StatusOK)
-		w := gzip.NewWriter(rw)
-		io.WriteString(w, s)
-		w.Close()
-	} else {
-		io.WriteString(rw, s)
-	}*/
-	//})
-
-	/*http.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
-		io.WriteString(rw, `<html>
-			<head><title>Node Exporter</title></head>
-			<body>
-			<h1>Node Exporter</h1>
-			<p><a href="/metrics">Metrics</a></p>
-			</body>
-			</html>`)
-	})
-
-	SetProcessName(fmt.Sprintf("remote_node_exporter: [%s@%s] listening %s", SshUser, SshHost, Port))
-
-	log.Fatal(http.ListenAndServe(":"+Port, nil))*/
-	//fmt.Println("#EOF")
+	for range tick(*interval) {
+		s, err := collect()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		fmt.Print(s)
+	}
 }
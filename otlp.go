@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTLPExporter sends the metrics to an OpenTelemetry collector with OTLP over
+// HTTP and protobuf on an interval.  Counters go as cumulative sums, so a
+// failed export loses nothing the next one does not carry, and is not
+// retried.
+type OTLPExporter struct {
+	Endpoint string // the full URL, ending in /v1/metrics
+	Headers  map[string]string
+	Interval time.Duration
+	Client   *Client
+
+	http *http.Client
+}
+
+// otlpEndpoint adds the metrics path to an endpoint given as just a base URL,
+// as OTEL_EXPORTER_OTLP_ENDPOINT is.
+func otlpEndpoint(endpoint string) string {
+	if u, err := url.Parse(endpoint); err == nil && strings.Trim(u.Path, "/") == "" {
+		return strings.TrimSuffix(endpoint, "/") + "/v1/metrics"
+	}
+	return endpoint
+}
+
+// parseOTLPHeaders reads headers in the form of OTEL_EXPORTER_OTLP_HEADERS,
+// key=value pairs separated by commas with the values URL encoded.
+func parseOTLPHeaders(s string, headers map[string]string) error {
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return fmt.Errorf("expected KEY=VALUE, got %q", pair)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("header %s: %v", k, err)
+		}
+		headers[strings.TrimSpace(k)] = value
+	}
+	return nil
+}
+
+// otlpUnits are the UCUM units of the base units a family name may end in.
+var otlpUnits = map[string]string{
+	"seconds": "s", "bytes": "By", "bits": "bit", "ratio": "1", "celsius": "Cel",
+	"volts": "V", "amperes": "A", "joules": "J", "grams": "g", "meters": "m",
+}
+
+// otlpResource is the host or a container on it, with the families of the
+// samples which belong to it.
+type otlpResource struct {
+	attrs Labels
+	fams  []*Family
+}
+
+// otlpResources splits the samples by the resource they describe.  The labels
+// the docker collector adds to the samples of a container become attributes
+// of a resource of its own, beside the host.name all resources carry.
+func otlpResources(fams []*Family, host string) []*otlpResource {
+	var list []*otlpResource
+	byKey := map[string]*otlpResource{}
+	for _, f := range fams {
+		split := map[*otlpResource]*Family{}
+		for _, s := range f.Samples {
+			attrs := Labels{"host.name": host}
+			if v, ok := s.Labels["docker_name"]; ok {
+				attrs["container.name"] = strings.TrimPrefix(v, "/")
+			}
+			if v, ok := s.Labels["docker_image"]; ok {
+				if strings.HasPrefix(v, "sha256:") {
+					attrs["container.image.id"] = v
+				} else {
+					attrs["container.image.name"] = v
+				}
+			}
+			if len(attrs) > 1 {
+				s.Labels = s.Labels.With(nil)
+				delete(s.Labels, "docker_name")
+				delete(s.Labels, "docker_image")
+			}
+
+			r, ok := byKey[attrs.key()]
+			if !ok {
+				r = &otlpResource{attrs: attrs}
+				byKey[attrs.key()] = r
+				list = append(list, r)
+			}
+			rf, ok := split[r]
+			if !ok {
+				rf = &Family{Name: f.Name, Type: f.Type, Help: f.Help}
+				split[r] = rf
+				r.fams = append(r.fams, rf)
+			}
+			rf.Samples = append(rf.Samples, s)
+		}
+	}
+	return list
+}
+
+// metricsRequest encodes the families as an OTLP ExportMetricsServiceRequest,
+// with the samples lacking a timestamp given now.  Histograms and summaries
+// are put back together from their _bucket, _sum and _count series.
+//
+//	message ExportMetricsServiceRequest { repeated ResourceMetrics resource_metrics = 1; }
+//	message ResourceMetrics { Resource resource = 1; repeated ScopeMetrics scope_metrics = 2; }
+//	message Resource { repeated KeyValue attributes = 1; }
+//	message ScopeMetrics { InstrumentationScope scope = 1; repeated Metric metrics = 2; }
+//	message InstrumentationScope { string name = 1; string version = 2; }
+//	message Metric { string name = 1; string description = 2; string unit = 3;
+//	  oneof data { Gauge gauge = 5; Sum sum = 7; Histogram histogram = 9; Summary summary = 11; } }
+//	message Gauge { repeated NumberDataPoint data_points = 1; }
+//	message Sum { repeated NumberDataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2; bool is_monotonic = 3; }
+//	message NumberDataPoint { repeated KeyValue attributes = 7; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3; double as_double = 4; }
+//	message Histogram { repeated HistogramDataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2; }
+//	message HistogramDataPoint { repeated KeyValue attributes = 9; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3; fixed64 count = 4;
+//	  optional double sum = 5; repeated fixed64 bucket_counts = 6; repeated double explicit_bounds = 7; }
+//	message Summary { repeated SummaryDataPoint data_points = 1; }
+//	message SummaryDataPoint { repeated KeyValue attributes = 7; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3; fixed64 count = 4;
+//	  double sum = 5; repeated ValueAtQuantile quantile_values = 6; }
+//	message ValueAtQuantile { double quantile = 1; double value = 2; }
+//	message KeyValue { string key = 1; AnyValue value = 2; }
+//	message AnyValue { oneof value { string string_value = 1; } }
+func metricsRequest(fams []*Family, host string, now time.Time) []byte {
+	var b protoBuf
+	for _, r := range otlpResources(fams, host) {
+		b.message(1, func(b *protoBuf) {
+			b.message(1, func(b *protoBuf) { b.attributes(1, r.attrs) })
+			b.message(2, func(b *protoBuf) {
+				b.message(1, func(b *protoBuf) {
+					b.string(1, "node-stats")
+					b.string(2, version)
+				})
+				for _, f := range r.fams {
+					b.message(2, func(b *protoBuf) { b.metric(f, now) })
+				}
+			})
+		})
+	}
+	return b
+}
+
+// Aggregation temporality of sums and histograms: the value since the start.
+const otlpCumulative = 2
+
+// processStart is the start time given the cumulative points.  The counters
+// of the host began before it, but it is the earliest time this process can
+// vouch for, and it stays the same for as long as the process runs, as the
+// start of a series must.
+var processStart = time.Now()
+
+// metric writes a family as an OTLP Metric.  Counters are monotonic sums,
+// while gauges and untyped families are gauges.  The points of sums,
+// histograms and summaries, which count up from a start, carry its time.
+func (b *protoBuf) metric(f *Family, now time.Time) {
+	b.string(1, f.Name)
+	b.string(2, f.Help)
+	b.string(3, otlpUnits[metricUnit(f.Name)])
+	switch f.Type {
+	case "counter":
+		b.message(7, func(b *protoBuf) {
+			for _, s := range f.Samples {
+				b.message(1, func(b *protoBuf) { b.numberPoint(s, processStart, now) })
+			}
+			b.varint(2, otlpCumulative)
+			b.varint(3, 1)
+		})
+	case "histogram":
+		b.message(9, func(b *protoBuf) {
+			for _, p := range distributionPoints(f, "le") {
+				b.message(1, func(b *protoBuf) {
+					b.attributes(9, p.labels)
+					b.fixed64(2, uint64(processStart.UnixNano()))
+					b.fixed64(3, p.time(now))
+					b.fixed64(4, uint64(p.count))
+					b.fixed64(5, math.Float64bits(p.sum))
+					var counts, bounds protoBuf
+					var last float64
+					for _, q := range p.values {
+						counts = append(counts, fixed64Bytes(uint64(q.value-last))...)
+						last = q.value
+						if !math.IsInf(q.bound, 1) {
+							bounds = append(bounds, fixed64Bytes(math.Float64bits(q.bound))...)
+						}
+					}
+					b.bytes(6, counts)
+					b.bytes(7, bounds)
+				})
+			}
+			b.varint(2, otlpCumulative)
+		})
+	case "summary":
+		b.message(11, func(b *protoBuf) {
+			for _, p := range distributionPoints(f, "quantile") {
+				b.message(1, func(b *protoBuf) {
+					b.attributes(7, p.labels)
+					b.fixed64(2, uint64(processStart.UnixNano()))
+					b.fixed64(3, p.time(now))
+					b.fixed64(4, uint64(p.count))
+					b.double(5, p.sum)
+					for _, q := range p.values {
+						b.message(6, func(b *protoBuf) {
+							b.double(1, q.bound)
+							b.double(2, q.value)
+						})
+					}
+				})
+			}
+		})
+	default:
+		b.message(5, func(b *protoBuf) {
+			for _, s := range f.Samples {
+				b.message(1, func(b *protoBuf) { b.numberPoint(s, time.Time{}, now) })
+			}
+		})
+	}
+}
+
+// numberPoint writes a sample as a NumberDataPoint, with the start time
+// unless it is zero, as for gauges.  The value is one of a oneof, so it is
+// written even when zero.
+func (b *protoBuf) numberPoint(s Sample, start, now time.Time) {
+	b.attributes(7, s.Labels)
+	if !start.IsZero() {
+		b.fixed64(2, uint64(start.UnixNano()))
+	}
+	b.fixed64(3, sampleTime(s.Timestamp, now))
+	b.fixed64(4, math.Float64bits(s.Value))
+}
+
+// attributes writes the labels as KeyValue messages holding strings.
+func (b *protoBuf) attributes(field int, l Labels) {
+	for _, k := range l.Names() {
+		b.message(field, func(b *protoBuf) {
+			b.string(1, k)
+			b.message(2, func(b *protoBuf) { b.string(1, l[k]) })
+		})
+	}
+}
+
+// sampleTime is the time of a sample in nanoseconds, now when it has none.
+func sampleTime(ms int64, now time.Time) uint64 {
+	if ms != 0 {
+		return uint64(ms) * 1e6
+	}
+	return uint64(now.UnixNano())
+}
+
+// distributionPoint is one series of a histogram or summary put back
+// together: the buckets or quantiles, by bound, with the sum and count.
+type distributionPoint struct {
+	labels    Labels
+	timestamp int64
+	count     float64
+	sum       float64
+	values    []struct{ bound, value float64 }
+}
+
+func (p *distributionPoint) time(now time.Time) uint64 {
+	return sampleTime(p.timestamp, now)
+}
+
+// distributionPoints groups the samples of a histogram or summary by their
+// labels other than the bound label, le or quantile.
+func distributionPoints(f *Family, boundLabel string) []*distributionPoint {
+	var points []*distributionPoint
+	byKey := map[string]*distributionPoint{}
+	for _, s := range f.Samples {
+		labels := s.Labels.With(nil)
+		delete(labels, boundLabel)
+		p, ok := byKey[labels.key()]
+		if !ok {
+			p = &distributionPoint{labels: labels}
+			byKey[labels.key()] = p
+			points = append(points, p)
+		}
+		if s.Timestamp > p.timestamp {
+			p.timestamp = s.Timestamp
+		}
+		switch s.Name {
+		case f.Name + "_sum":
+			p.sum = s.Value
+		case f.Name + "_count":
+			p.count = s.Value
+		default:
+			bound, err := strconv.ParseFloat(s.Labels[boundLabel], 64)
+			if err != nil {
+				continue
+			}
+			p.values = append(p.values, struct{ bound, value float64 }{bound, s.Value})
+		}
+	}
+	for _, p := range points {
+		sort.Slice(p.values, func(i, j int) bool { return p.values[i].bound < p.values[j].bound })
+		if boundLabel == "le" && (len(p.values) == 0 || !math.IsInf(p.values[len(p.values)-1].bound, 1)) {
+			// The +Inf bucket holds everything, the count
+			p.values = append(p.values, struct{ bound, value float64 }{math.Inf(1), p.count})
+		}
+	}
+	return points
+}
+
+// Run exports on every tick of the interval and does not return.
+func (e *OTLPExporter) Run() {
+	if e.http == nil {
+		e.http = &http.Client{Timeout: e.Interval}
+	}
+	log.Printf("Exporting to %s every %v\n", e.Endpoint, e.Interval)
+	for range tick(e.Interval) {
+		if err := e.Export(); err != nil {
+			log.Printf("otlp export to %s: %v\n", e.Endpoint, err)
+		}
+	}
+}
+
+// Export collects once and posts the result.
+func (e *OTLPExporter) Export() error {
+	now := time.Now()
+	m := Metrics{Client: e.Client, Format: FormatPrometheus}
+	_, err := m.CollectAll()
+	fams := m.Families()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.Endpoint, bytes.NewReader(metricsRequest(fams, m.host(), now)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "node-stats/"+version)
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	_, err = sendRequest(e.http, req)
+	return err
+}
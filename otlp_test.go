@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOTLPEndpoint(t *testing.T) {
+	for in, want := range map[string]string{
+		"http://otel:4318":            "http://otel:4318/v1/metrics",
+		"http://otel:4318/":           "http://otel:4318/v1/metrics",
+		"https://otel/custom/metrics": "https://otel/custom/metrics",
+	} {
+		if got := otlpEndpoint(in); got != want {
+			t.Errorf("otlpEndpoint(%s) = %s, want %s", in, got, want)
+		}
+	}
+
+	headers := map[string]string{}
+	if err := parseOTLPHeaders("api-key=abc%3D, x-team = ops", headers); err != nil || headers["api-key"] != "abc=" || headers["x-team"] != "ops" {
+		t.Errorf("headers %v, %v", headers, err)
+	}
+	if err := parseOTLPHeaders("novalue", headers); err == nil {
+		t.Error("header without a value did not fail")
+	}
+}
+
+// otlpAttributes decodes repeated KeyValue messages holding strings.
+func otlpAttributes(t *testing.T, kvs []interface{}) string {
+	t.Helper()
+	var attrs []string
+	for _, kv := range kvs {
+		f := protoFields(t, kv.([]byte))
+		v := protoFields(t, f[2][0].([]byte))
+		attrs = append(attrs, string(f[1][0].([]byte))+"="+string(v[1][0].([]byte)))
+	}
+	return strings.Join(attrs, ",")
+}
+
+// fixed is a fixed64 integer field, which protoFields decodes as a double.
+func fixed(v interface{}) uint64 {
+	return math.Float64bits(v.(float64))
+}
+
+func TestMetricsRequest(t *testing.T) {
+	fams := []*Family{
+		{Name: "docker_restarts_total", Type: "counter", Help: "Restarts", Samples: []Sample{
+			{Labels: Labels{"docker_name": "/web", "docker_image": "nginx:1.27"}, Value: 0},
+			{Labels: Labels{"docker_name": "/db", "docker_image": "sha256:5d0d", "reason": "oom"}, Value: 2},
+		}},
+		{Name: "node_load1", Type: "gauge", Samples: []Sample{{Value: 0.5, Timestamp: 1000}}},
+		{Name: "node_latency_seconds", Type: "histogram", Samples: []Sample{
+			{Name: "node_latency_seconds_bucket", Labels: Labels{"le": "0.1"}, Value: 1},
+			{Name: "node_latency_seconds_bucket", Labels: Labels{"le": "1"}, Value: 3},
+			{Name: "node_latency_seconds_bucket", Labels: Labels{"le": "+Inf"}, Value: 4},
+			{Name: "node_latency_seconds_sum", Value: 2.5},
+			{Name: "node_latency_seconds_count", Value: 4},
+		}},
+	}
+	req := protoFields(t, metricsRequest(fams, "web1", time.Unix(2, 0)))
+
+	var resources []string
+	metrics := map[string]map[int][]interface{}{}
+	for _, rm := range req[1] {
+		r := protoFields(t, rm.([]byte))
+		resource := otlpAttributes(t, protoFields(t, r[1][0].([]byte))[1])
+		resources = append(resources, resource)
+		sm := protoFields(t, r[2][0].([]byte))
+		if scope := protoFields(t, sm[1][0].([]byte)); string(scope[1][0].([]byte)) != "node-stats" {
+			t.Errorf("scope %q", scope[1][0])
+		}
+		for _, m := range sm[2] {
+			mf := protoFields(t, m.([]byte))
+			metrics[resource+" "+string(mf[1][0].([]byte))] = mf
+		}
+	}
+	want := "container.image.name=nginx:1.27,container.name=web,host.name=web1|container.image.id=sha256:5d0d,container.name=db,host.name=web1|host.name=web1"
+	if strings.Join(resources, "|") != want {
+		t.Fatalf("resources %q, want %q", resources, want)
+	}
+
+	// A counter is a cumulative monotonic sum, its zero value written
+	sum := metrics["container.image.name=nginx:1.27,container.name=web,host.name=web1 docker_restarts_total"]
+	if sum == nil || sum[7] == nil || string(sum[2][0].([]byte)) != "Restarts" {
+		t.Fatalf("counter %v", sum)
+	}
+	s := protoFields(t, sum[7][0].([]byte))
+	point := protoFields(t, s[1][0].([]byte))
+	if s[2][0].(uint64) != otlpCumulative || s[3][0].(uint64) != 1 || point[4] == nil || point[4][0].(float64) != 0 || point[7] != nil {
+		t.Errorf("sum %v, point %v", s, point)
+	}
+	if point[2] == nil || fixed(point[2][0]) != uint64(processStart.UnixNano()) {
+		t.Errorf("sum start time %v", point[2])
+	}
+	db := protoFields(t, protoFields(t, metrics["container.image.id=sha256:5d0d,container.name=db,host.name=web1 docker_restarts_total"][7][0].([]byte))[1][0].([]byte))
+	if otlpAttributes(t, db[7]) != "reason=oom" || db[4][0].(float64) != 2 {
+		t.Errorf("db point %v", db)
+	}
+
+	// A gauge keeps the time of its sample and gets its unit
+	gauge := metrics["host.name=web1 node_load1"]
+	if gauge == nil || gauge[5] == nil {
+		t.Fatalf("gauge %v", gauge)
+	}
+	if point := protoFields(t, protoFields(t, gauge[5][0].([]byte))[1][0].([]byte)); fixed(point[3][0]) != 1000*1e6 || point[2] != nil {
+		t.Errorf("gauge time %v, start time %v", point[3], point[2])
+	}
+
+	hist := metrics["host.name=web1 node_latency_seconds"]
+	if hist == nil || hist[9] == nil || string(hist[3][0].([]byte)) != "s" {
+		t.Fatalf("histogram %v", hist)
+	}
+	hp := protoFields(t, protoFields(t, hist[9][0].([]byte))[1][0].([]byte))
+	counts, bounds := hp[6][0].([]byte), hp[7][0].([]byte)
+	var got []uint64
+	for i := 0; i < len(counts); i += 8 {
+		got = append(got, binary.LittleEndian.Uint64(counts[i:]))
+	}
+	if fixed(hp[2][0]) != uint64(processStart.UnixNano()) || fixed(hp[4][0]) != 4 || hp[5][0].(float64) != 2.5 || len(bounds) != 16 || len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 1 {
+		t.Errorf("histogram point %v, bucket counts %v", hp, got)
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	fixtureLoadavg(t)
+
+	var body []byte
+	var contentType, apiKey string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/metrics" {
+			http.NotFound(rw, req)
+			return
+		}
+		body, _ = io.ReadAll(req.Body)
+		contentType, apiKey = req.Header.Get("Content-Type"), req.Header.Get("api-key")
+	}))
+	defer srv.Close()
+
+	e := &OTLPExporter{Endpoint: otlpEndpoint(srv.URL), Headers: map[string]string{"api-key": "abc"}}
+	if err := e.Export(); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "application/x-protobuf" || apiKey != "abc" || !strings.Contains(string(body), "node_load1") {
+		t.Errorf("content type %q, api key %q, body %q", contentType, apiKey, body)
+	}
+
+	e.Endpoint = srv.URL + "/elsewhere"
+	if err := e.Export(); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("export to a bad path: %v", err)
+	}
+}
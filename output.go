@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileWriter writes each collection to a file, for the textfile collector of
+// a node_exporter already running on the host.  The file is replaced whole so
+// the reader never sees half of it, and removed when the metrics in it go
+// stale: on SIGTERM, and when no collection has been written for MaxAge.
+type FileWriter struct {
+	File     string
+	Interval time.Duration
+	MaxAge   time.Duration
+	Collect  func() (string, error)
+}
+
+// writeFileAtomic replaces the file with the data through a temporary file in
+// the same directory, renamed in place once complete.  The temporary file is
+// hidden so a textfile collector globbing *.prom passes it by.
+func writeFileAtomic(file string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // once renamed, there is nothing left to remove
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// WriteOnce collects and writes the file.
+func (w *FileWriter) WriteOnce() error {
+	s, err := w.Collect()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(w.File, []byte(s))
+}
+
+// remove drops the file so stale metrics are not served.
+func (w *FileWriter) remove() {
+	if err := os.Remove(w.File); err != nil && !os.IsNotExist(err) {
+		log.Printf("removing %s: %v\n", w.File, err)
+	}
+}
+
+// Run writes on every tick of the interval until a signal arrives on stop,
+// when it removes the file and returns.
+func (w *FileWriter) Run(stop <-chan os.Signal) {
+	// A file left behind by an earlier run which died is stale already
+	if fi, err := os.Stat(w.File); err == nil && w.MaxAge > 0 && time.Since(fi.ModTime()) > w.MaxAge {
+		log.Printf("%s is older than %v, removing it\n", w.File, w.MaxAge)
+		w.remove()
+	}
+
+	log.Printf("Writing to %s every %v\n", w.File, w.Interval)
+	last := time.Now()
+	ticks := tick(w.Interval)
+	for {
+		select {
+		case sig := <-stop:
+			log.Printf("%v received, removing %s\n", sig, w.File)
+			w.remove()
+			return
+		case <-ticks:
+		}
+		err := w.WriteOnce()
+		if err == nil {
+			last = time.Now()
+			continue
+		}
+		log.Printf("writing %s: %v\n", w.File, err)
+		if w.MaxAge > 0 && time.Since(last) > w.MaxAge {
+			log.Printf("nothing written to %s for %v, removing it\n", w.File, w.MaxAge)
+			w.remove()
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "node-stats.prom")
+	for _, s := range []string{"node_load1 1\n", "node_load1 2\n"} {
+		if err := writeFileAtomic(file, []byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := os.ReadFile(file); string(b) != s {
+			t.Errorf("file holds %q, want %q", b, s)
+		}
+	}
+	if fi, _ := os.Stat(file); fi.Mode().Perm() != 0644 {
+		t.Errorf("mode %v, want 0644", fi.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files left: %v", entries)
+	}
+}
+
+func TestChosenCollectorsOnly(t *testing.T) {
+	saved := Collectors
+	defer func() { Collectors = saved }()
+	Collectors = []*Collector{{Name: "loadavg", Enabled: true}, {Name: "script", Enabled: true}, {Name: "time"}}
+	if ChosenCollectorsOnly() {
+		t.Error("collectors left with none chosen")
+	}
+	Collectors[2].chosen = true
+	if !ChosenCollectorsOnly() || Collectors[0].Enabled || Collectors[1].Enabled || !Collectors[2].Enabled {
+		t.Errorf("enabled loadavg %v, script %v, time %v", Collectors[0].Enabled, Collectors[1].Enabled, Collectors[2].Enabled)
+	}
+}
+
+func TestFileWriter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "node-stats.prom")
+	exists := func() bool { _, err := os.Stat(file); return err == nil }
+
+	// A file left by an earlier run is removed, and a signal removes the
+	// file written since
+	os.WriteFile(file, []byte("node_load1 0\n"), 0644)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(file, old, old)
+	var writes int32
+	w := &FileWriter{File: file, Interval: 10 * time.Millisecond, MaxAge: time.Minute, Collect: func() (string, error) {
+		atomic.AddInt32(&writes, 1)
+		return "node_load1 1\n", nil
+	}}
+	stop := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() { w.Run(stop); close(done) }()
+	waitFor(t, "writes", func() bool { return atomic.LoadInt32(&writes) >= 2 })
+	if b, _ := os.ReadFile(file); string(b) != "node_load1 1\n" {
+		t.Errorf("file holds %q", b)
+	}
+	stop <- syscall.SIGTERM
+	<-done
+	if exists() {
+		t.Error("file left after SIGTERM")
+	}
+
+	// Once collections have failed for longer than MaxAge the file goes
+	var fail atomic.Bool
+	w.MaxAge = 50 * time.Millisecond
+	w.Collect = func() (string, error) {
+		if fail.Load() {
+			return "", errors.New("collection failed")
+		}
+		return "node_load1 1\n", nil
+	}
+	done = make(chan struct{})
+	go func() { w.Run(stop); close(done) }()
+	waitFor(t, "the file", exists)
+	fail.Store(true)
+	waitFor(t, "the stale file to be removed", func() bool { return !exists() })
+	stop <- syscall.SIGTERM
+	<-done
+}
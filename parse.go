@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// metricTypes are the types a # TYPE line may announce.
+var metricTypes = map[string]bool{
+	"counter": true, "gauge": true, "histogram": true, "summary": true, "untyped": true,
+}
+
+// validMetricName reports if s may be used as a metric name.
+func validMetricName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_', c == ':', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validLabelName reports if s may be used as a label name.
+func validLabelName(s string) bool {
+	return s != "" && labelName(s) == s
+}
+
+// seriesFamily finds the family a sample belongs to.  Histograms and
+// summaries are announced under their base name while the samples carry a
+// _bucket, _sum or _count suffix.
+func seriesFamily(fams map[string]*Family, name string) (*Family, bool) {
+	if f, ok := fams[name]; ok {
+		return f, true
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		base := strings.TrimSuffix(name, suffix)
+		if base == name {
+			continue
+		}
+		if f, ok := fams[base]; ok && (f.Type == "histogram" || f.Type == "summary" && suffix != "_bucket") {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// ParseText reads metrics in the Prometheus text exposition format, as
+// written by batch jobs for the textfile collector or printed by scripts.
+// Anything which would not survive being passed on to a scraper is an error:
+// a bad name, label or value, a repeated series, or a TYPE or HELP given twice
+// or after the samples of its family.
+func ParseText(s string) ([]*Family, error) {
+	fams := make(map[string]*Family)
+	var order []*Family
+	seen := make(map[string]bool)
+	helped := make(map[string]bool)
+
+	get := func(name string) *Family {
+		f, ok := fams[name]
+		if !ok {
+			f = &Family{Name: name, Type: "untyped"}
+			fams[name] = f
+			order = append(order, f)
+		}
+		return f
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			parts := strings.SplitN(strings.TrimSpace(line[1:]), " ", 3)
+			if len(parts) < 3 || (parts[0] != "HELP" && parts[0] != "TYPE") {
+				continue // a plain comment
+			}
+			name := parts[1]
+			if !validMetricName(name) {
+				return nil, fmt.Errorf("line %d: invalid metric name %q", n, name)
+			}
+			f := get(name)
+			if len(f.Samples) > 0 {
+				return nil, fmt.Errorf("line %d: %s for %s after its samples", n, parts[0], name)
+			}
+			switch parts[0] {
+			case "HELP":
+				if helped[name] {
+					return nil, fmt.Errorf("line %d: second HELP for %s", n, name)
+				}
+				helped[name] = true
+				f.Help = strings.TrimSuffix(unescapeHelp(parts[2]), ".")
+			case "TYPE":
+				typ := strings.TrimSpace(parts[2])
+				if !metricTypes[typ] {
+					return nil, fmt.Errorf("line %d: unknown type %q for %s", n, typ, name)
+				}
+				if f.Type != "untyped" {
+					return nil, fmt.Errorf("line %d: second TYPE for %s", n, name)
+				}
+				f.Type = typ
+			}
+			continue
+		}
+
+		name, sample, err := parseSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		f, ok := seriesFamily(fams, name)
+		if !ok {
+			f = get(name)
+		}
+		if name != f.Name {
+			sample.Name = name
+		}
+		key := sampleKey(f, sample)
+		if seen[key] {
+			return nil, fmt.Errorf("line %d: duplicate series %s%s", n, name, formatLabels(sample.Labels))
+		}
+		seen[key] = true
+		f.Samples = append(f.Samples, sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Family, 0, len(order))
+	for _, f := range order {
+		if len(f.Samples) > 0 {
+			ret = append(ret, f)
+		}
+	}
+	return ret, nil
+}
+
+func unescapeHelp(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(s)
+}
+
+// parseSample reads one sample line: a name, optional labels, the value and
+// an optional timestamp in milliseconds.
+func parseSample(line string) (string, Sample, error) {
+	var sample Sample
+	i := strings.IndexAny(line, "{ \t")
+	if i < 0 {
+		return "", sample, fmt.Errorf("no value in %q", line)
+	}
+	name := line[:i]
+	if !validMetricName(name) {
+		return "", sample, fmt.Errorf("invalid metric name %q", name)
+	}
+	rest := line[i:]
+	if rest[0] == '{' {
+		labels, n, err := parseLabels(rest)
+		if err != nil {
+			return "", sample, fmt.Errorf("%s: %v", name, err)
+		}
+		sample.Labels = labels
+		rest = rest[n:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return "", sample, fmt.Errorf("%s: expected a value and an optional timestamp", name)
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", sample, fmt.Errorf("%s: invalid value %q", name, fields[0])
+	}
+	sample.Value = v
+	if len(fields) == 2 {
+		ts, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return "", sample, fmt.Errorf("%s: invalid timestamp %q", name, fields[1])
+		}
+		sample.Timestamp = ts
+	}
+	return name, sample, nil
+}
+
+// parseLabels reads a {name="value",...} block from the start of s and
+// returns the labels and the length of the block.
+func parseLabels(s string) (Labels, int, error) {
+	labels := Labels{}
+	i := 1
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+		if i < len(s) && s[i] == '}' {
+			return labels, i + 1, nil
+		}
+		eq := strings.IndexByte(s[i:], '=')
+		if eq < 0 {
+			return nil, 0, fmt.Errorf("unterminated labels")
+		}
+		name := strings.TrimSpace(s[i : i+eq])
+		if !validLabelName(name) {
+			return nil, 0, fmt.Errorf("invalid label name %q", name)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, 0, fmt.Errorf("duplicate label %q", name)
+		}
+		i += eq + 1
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+		if i >= len(s) || s[i] != '"' {
+			return nil, 0, fmt.Errorf("label %s is not quoted", name)
+		}
+		i++
+
+		var b strings.Builder
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] != '\\' {
+				b.WriteByte(s[i])
+				continue
+			}
+			i++
+			if i >= len(s) {
+				break
+			}
+			switch s[i] {
+			case '\\', '"':
+				b.WriteByte(s[i])
+			case 'n':
+				b.WriteByte('\n')
+			default:
+				return nil, 0, fmt.Errorf("invalid escape \\%c in label %s", s[i], name)
+			}
+		}
+		if i >= len(s) {
+			return nil, 0, fmt.Errorf("unterminated value for label %s", name)
+		}
+		labels[name] = b.String()
+		i++
+
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+		if i < len(s) && s[i] == ',' {
+			i++
+		} else if i >= len(s) || s[i] != '}' {
+			return nil, 0, fmt.Errorf("expected , or } after label %s", name)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseText(t *testing.T) {
+	fams, err := ParseText(`# HELP a_total Things with \\ and \n in the help.
+# TYPE a_total counter
+a_total{path="C:\\tmp",quote="say \"hi\"",} 3 1792300583213
+# A comment
+b 1.5e3
+# TYPE h summary
+h{quantile="0.5"} 1
+h_sum 10
+h_count 4
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fams) != 3 {
+		t.Fatalf("got %d families", len(fams))
+	}
+	a := fams[0]
+	if a.Type != "counter" || a.Help != "Things with \\ and \n in the help" {
+		t.Errorf("a_total = %q %q", a.Type, a.Help)
+	}
+	if s := a.Samples[0]; s.Labels["path"] != `C:\tmp` || s.Labels["quote"] != `say "hi"` || s.Value != 3 || s.Timestamp != 1792300583213 {
+		t.Errorf("a_total sample = %#v", s)
+	}
+	if b := fams[1]; b.Type != "untyped" || b.Samples[0].Value != 1500 {
+		t.Errorf("b = %#v", b)
+	}
+	if h := fams[2]; len(h.Samples) != 3 || h.Samples[1].Name != "h_sum" || h.Samples[0].Name != "" {
+		t.Errorf("h = %#v", h)
+	}
+}
+
+func TestParseTextErrors(t *testing.T) {
+	for _, tc := range []struct{ in, err string }{
+		{"1abc 1", "invalid metric name"},
+		{"a{b=\"c\"", "expected , or }"},
+		{"a{b=\"c", "unterminated value"},
+		{"a{b=c} 1", "not quoted"},
+		{"a{b=\"c\",b=\"d\"} 1", "duplicate label"},
+		{"a{__b-c=\"c\"} 1", "invalid label name"},
+		{"a{b=\"\\x\"} 1", "invalid escape"},
+		{"a one", "invalid value"},
+		{"a 1 2 3", "expected a value"},
+		{"a 1\na 2", "duplicate series"},
+		{"# TYPE a gauge\n# TYPE a counter", "second TYPE"},
+		{"# TYPE a meter", "unknown type"},
+		{"a 1\n# TYPE a gauge", "after its samples"},
+	} {
+		_, err := ParseText(tc.in)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("ParseText(%q) error = %v, want %q", tc.in, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PreRead fetches every file the collectors will read from the remote host
+// in one round-trip, so a scrape does not cost a session per file.  Reads of
+// anything else still go to the host.  It is given as long as a collector,
+// and what it has not fetched by then the collectors read for themselves.
+func (m *Metrics) PreRead() error {
+	ctx, cancel := context.WithTimeout(m.context(), collectorTimeout)
+	defer cancel()
+
+	b := newBatchFS(remoteFS{c: m.Client}, PreReadFileList(), PreReadTrees())
+	out, err := m.Client.ExecuteContext(ctx, b.script())
+	if err != nil && out == "" {
+		return err
+	}
+	b.parse(out)
+	m.FS = b
+	return nil
+}
+
+// batchFS answers reads from files fetched all at once.  The files are given
+// as paths or glob patterns, and trees as a root with the names of the files
+// wanted anywhere below it.  A read of a path which was asked for but not
+// found fails as a missing file without going back to the host.
+type batchFS struct {
+	FS
+
+	files []string
+	trees map[string][]string
+	roots []string
+
+	content map[string]string
+	mtimes  map[string]time.Time
+}
+
+func newBatchFS(fs FS, files []string, trees map[string][]string) *batchFS {
+	b := &batchFS{
+		FS:      fs,
+		files:   files,
+		trees:   trees,
+		content: make(map[string]string),
+		mtimes:  make(map[string]time.Time),
+	}
+	for root := range trees {
+		b.roots = append(b.roots, root)
+	}
+	sort.Strings(b.roots)
+	return b
+}
+
+// globQuote quotes a path for the shell but leaves * and ? to be expanded.
+func globQuote(p string) string {
+	var b strings.Builder
+	last := 0
+	for i := 0; i < len(p); i++ {
+		if p[i] != '*' && p[i] != '?' {
+			continue
+		}
+		if i > last {
+			b.WriteString(shellQuote(p[last:i]))
+		}
+		b.WriteByte(p[i])
+		last = i + 1
+	}
+	if last < len(p) {
+		b.WriteString(shellQuote(p[last:]))
+	}
+	return b.String()
+}
+
+// withContext binds the reads of anything not fetched to ctx.
+func (b *batchFS) withContext(ctx context.Context) FS {
+	if fs, ok := b.FS.(contextFS); ok {
+		bound := *b
+		bound.FS = fs.withContext(ctx)
+		return &bound
+	}
+	return b
+}
+
+// globDirs are the directories the patterns list, which are stated along
+// with the files so a missing directory can be told from an empty one.
+func (b *batchFS) globDirs() []string {
+	var dirs []string
+	for _, f := range b.files {
+		dir := filepath.Dir(f)
+		if strings.ContainsAny(f, "*?") && !strings.ContainsAny(dir, "*?") {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// script is one shell command printing the lines of every file prefixed
+// with its path, as grep -H does, then a -- line, then the mtime and path of
+// every file and tree root found.  Only grep, find and stat are needed, which
+// busybox has.
+func (b *batchFS) script() string {
+	var files, dirs, roots, names []string
+	for _, f := range b.files {
+		files = append(files, globQuote(f))
+	}
+	for _, d := range b.globDirs() {
+		dirs = append(dirs, shellQuote(d))
+	}
+	seen := make(map[string]bool)
+	for _, root := range b.roots {
+		roots = append(roots, shellQuote(root))
+		for _, n := range b.trees[root] {
+			if !seen[n] {
+				seen[n] = true
+				names = append(names, "-name "+shellQuote(n))
+			}
+		}
+	}
+
+	var find string
+	if len(roots) > 0 {
+		find = "find " + strings.Join(roots, " ") + ` -type f \( ` + strings.Join(names, " -o ") + ` \) -exec `
+	}
+
+	var cmd []string
+	if len(files) > 0 {
+		cmd = append(cmd, "grep -H '' -- "+strings.Join(files, " ")+" 2>/dev/null")
+	}
+	if find != "" {
+		cmd = append(cmd, find+"grep -H '' {} + 2>/dev/null")
+	}
+	cmd = append(cmd, "echo --")
+	if stat := append(append(files, dirs...), roots...); len(stat) > 0 {
+		cmd = append(cmd, "stat -c '%Y %n' -- "+strings.Join(stat, " ")+" 2>/dev/null")
+	}
+	if find != "" {
+		cmd = append(cmd, find+"stat -c '%Y %n' {} + 2>/dev/null")
+	}
+	return strings.Join(cmd, "; ") + "; true"
+}
+
+// parse reads the output of the script.  The stat lines come last but are
+// needed first, to tell where the path ends in a line of content.
+func (b *batchFS) parse(out string) {
+	content, stats, _ := strings.Cut("\n"+out, "\n--\n")
+	for _, line := range strings.Split(stats, "\n") {
+		sec, name, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseInt(sec, 10, 64); err == nil {
+			b.mtimes[name] = time.Unix(n, 0)
+		}
+	}
+
+	found := make(map[string]*strings.Builder)
+	for _, line := range strings.Split(content, "\n") {
+		for i := strings.IndexByte(line, ':'); i >= 0; {
+			if _, ok := b.mtimes[line[:i]]; ok {
+				sb := found[line[:i]]
+				if sb == nil {
+					sb = &strings.Builder{}
+					found[line[:i]] = sb
+				}
+				sb.WriteString(line[i+1:])
+				sb.WriteByte('\n')
+				break
+			}
+			j := strings.IndexByte(line[i+1:], ':')
+			if j < 0 {
+				break
+			}
+			i += j + 1
+		}
+	}
+	for name, sb := range found {
+		b.content[name] = sb.String()
+	}
+}
+
+// fetched reports if the path was among those asked for, so that it not
+// being found means it does not exist.
+func (b *batchFS) fetched(name string) bool {
+	for _, f := range b.files {
+		if ok, _ := filepath.Match(f, name); ok {
+			return true
+		}
+	}
+	for _, root := range b.roots {
+		if !strings.HasPrefix(name, root+"/") {
+			continue
+		}
+		for _, n := range b.trees[root] {
+			if filepath.Base(name) == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b *batchFS) ReadFile(name string) ([]byte, error) {
+	if s, ok := b.content[name]; ok {
+		return []byte(s), nil
+	}
+	if b.fetched(name) {
+		if _, ok := b.mtimes[name]; ok {
+			return []byte{}, nil // found, but grep had no lines to print
+		}
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return b.FS.ReadFile(name)
+}
+
+func (b *batchFS) ModTime(name string) (time.Time, error) {
+	if t, ok := b.mtimes[name]; ok {
+		return t, nil
+	}
+	if b.fetched(name) {
+		return time.Time{}, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return b.FS.ModTime(name)
+}
+
+// ReadDir of a directory holding a pattern lists the files which matched it;
+// the collectors only look for those.
+func (b *batchFS) ReadDir(name string) ([]string, error) {
+	for _, dir := range b.globDirs() {
+		if dir != name {
+			continue
+		}
+		if _, ok := b.mtimes[dir]; !ok {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		var names []string
+		for p := range b.mtimes {
+			if filepath.Dir(p) == dir && p != dir && b.fetched(p) {
+				names = append(names, filepath.Base(p))
+			}
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	return b.FS.ReadDir(name)
+}
+
+// Walk of a tree goes over the files found in it and the directories
+// leading to them.
+func (b *batchFS) Walk(root string, fn filepath.WalkFunc) error {
+	if _, ok := b.trees[root]; !ok {
+		return b.FS.Walk(root, fn)
+	}
+	if _, ok := b.mtimes[root]; !ok {
+		return fn(root, nil, &os.PathError{Op: "lstat", Path: root, Err: os.ErrNotExist})
+	}
+
+	isDir := map[string]bool{root: true}
+	paths := []string{root}
+	for p := range b.mtimes {
+		if !strings.HasPrefix(p, root+"/") || !b.fetched(p) {
+			continue
+		}
+		paths = append(paths, p)
+		for d := filepath.Dir(p); d != root && !isDir[d]; d = filepath.Dir(d) {
+			isDir[d] = true
+			paths = append(paths, d)
+		}
+	}
+	return walkPaths(paths, isDir, fn)
+}
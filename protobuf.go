@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Wire types of the protocol buffer encoding.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// protoBuf is a protocol buffer message being written.  The messages sent
+// are few and small, so they are written by hand rather than generated.
+// Fields holding the zero value are left out, as proto3 does.
+type protoBuf []byte
+
+func (b *protoBuf) tag(field, wire int) {
+	*b = binary.AppendUvarint(*b, uint64(field)<<3|uint64(wire))
+}
+
+func (b *protoBuf) varint(field int, v uint64) {
+	if v != 0 {
+		b.tag(field, wireVarint)
+		*b = binary.AppendUvarint(*b, v)
+	}
+}
+
+// int64 writes a signed value as protobuf int64, not sint64.
+func (b *protoBuf) int64(field int, v int64) {
+	b.varint(field, uint64(v))
+}
+
+func (b *protoBuf) double(field int, v float64) {
+	if v != 0 || math.Signbit(v) {
+		b.tag(field, wireFixed64)
+		*b = binary.LittleEndian.AppendUint64(*b, math.Float64bits(v))
+	}
+}
+
+// fixed64 writes a fixed64 field, or a double given its bits, even when zero
+// as members of a oneof and optional fields need.
+func (b *protoBuf) fixed64(field int, v uint64) {
+	b.tag(field, wireFixed64)
+	*b = append(*b, fixed64Bytes(v)...)
+}
+
+// fixed64Bytes is a fixed64 value as it is written, for packed repeated
+// fields.
+func fixed64Bytes(v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, v)
+}
+
+func (b *protoBuf) bytes(field int, p []byte) {
+	if len(p) > 0 {
+		b.tag(field, wireBytes)
+		*b = binary.AppendUvarint(*b, uint64(len(p)))
+		*b = append(*b, p...)
+	}
+}
+
+func (b *protoBuf) string(field int, s string) {
+	b.bytes(field, []byte(s))
+}
+
+// message writes an embedded message, which is written even when empty.
+func (b *protoBuf) message(field int, fn func(*protoBuf)) {
+	var m protoBuf
+	fn(&m)
+	b.tag(field, wireBytes)
+	*b = binary.AppendUvarint(*b, uint64(len(m)))
+	*b = append(*b, m...)
+}
+
+// FormatProtobuf is the delimited protobuf exposition format, which
+// Prometheus parses faster than text and asks for when configured to.
+const FormatProtobuf = "protobuf"
+
+// protobufMessage is the message type of the protobuf exposition format.
+const protobufMessage = "io.prometheus.client.MetricFamily"
+
+func init() {
+	contentTypes[FormatProtobuf] = "application/vnd.google.protobuf; proto=" + protobufMessage + "; encoding=delimited"
+}
+
+// MetricType values of the protobuf exposition format.
+var protobufTypes = map[string]uint64{
+	"counter": 0, "gauge": 1, "summary": 2, "untyped": 3, "histogram": 4,
+}
+
+// WriteProtobuf writes the families as MetricFamily messages, each preceded
+// by its length.  Histograms and summaries are put back together from their
+// _bucket, _sum and _count series, the +Inf bucket being left implicit as the
+// count.
+//
+//	message MetricFamily { string name = 1; string help = 2; MetricType type = 3; repeated Metric metric = 4; string unit = 5; }
+//	message Metric { repeated LabelPair label = 1; Gauge gauge = 2; Counter counter = 3; Summary summary = 4;
+//	  Untyped untyped = 5; Histogram histogram = 7; int64 timestamp_ms = 6; }
+//	message LabelPair { string name = 1; string value = 2; }
+//	message Gauge { double value = 1; }  // and the same for Counter and Untyped
+//	message Summary { uint64 sample_count = 1; double sample_sum = 2; repeated Quantile quantile = 3; }
+//	message Quantile { double quantile = 1; double value = 2; }
+//	message Histogram { uint64 sample_count = 1; double sample_sum = 2; repeated Bucket bucket = 3; }
+//	message Bucket { uint64 cumulative_count = 1; double upper_bound = 2; }
+func WriteProtobuf(w io.Writer, fams []*Family) error {
+	for _, f := range fams {
+		var b protoBuf
+		b.string(1, f.Name)
+		b.string(2, f.Help)
+		b.varint(3, protobufTypes[f.Type])
+		switch f.Type {
+		case "histogram", "summary":
+			bound := "le"
+			if f.Type == "summary" {
+				bound = "quantile"
+			}
+			for _, p := range distributionPoints(f, bound) {
+				b.message(4, func(b *protoBuf) {
+					b.labelPairs(p.labels)
+					field := 7
+					if f.Type == "summary" {
+						field = 4
+					}
+					b.message(field, func(b *protoBuf) {
+						b.varint(1, uint64(p.count))
+						b.double(2, p.sum)
+						for _, q := range p.values {
+							if math.IsInf(q.bound, 1) {
+								continue
+							}
+							b.message(3, func(b *protoBuf) {
+								if f.Type == "summary" {
+									b.double(1, q.bound)
+									b.double(2, q.value)
+								} else {
+									b.varint(1, uint64(q.value))
+									b.double(2, q.bound)
+								}
+							})
+						}
+					})
+					b.int64(6, p.timestamp)
+				})
+			}
+		default:
+			field := map[string]int{"counter": 3, "gauge": 2}[f.Type]
+			if field == 0 {
+				field = 5
+			}
+			for _, s := range f.Samples {
+				b.message(4, func(b *protoBuf) {
+					b.labelPairs(s.Labels)
+					b.message(field, func(b *protoBuf) { b.double(1, s.Value) })
+					b.int64(6, s.Timestamp)
+				})
+			}
+		}
+		b.string(5, metricUnit(f.Name))
+
+		if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(b)))); err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labelPairs writes the labels as LabelPair messages.
+func (b *protoBuf) labelPairs(l Labels) {
+	for _, k := range l.Names() {
+		b.message(1, func(b *protoBuf) {
+			b.string(1, labelName(k))
+			b.string(2, l[k])
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Pusher sends the metrics to a Pushgateway on an interval, for hosts which
+// cannot be scraped.  Each push replaces the metrics last pushed under the
+// same job, instance and grouping labels.
+type Pusher struct {
+	URL      string
+	Job      string
+	Instance string
+	Grouping Labels // more labels to group by
+	User     string
+	Password string
+	Interval time.Duration
+	Retries  int // tries after the first for each push
+	Client   *Client
+
+	http *http.Client
+}
+
+// pushRetryWait is the wait before the first retry of a push, doubling after
+// each.
+var pushRetryWait = time.Second
+
+// groupingPath is the part of the push URL naming the group, with values
+// holding a slash or empty sent in the base64 form the Pushgateway accepts.
+func (p *Pusher) groupingPath() string {
+	var b strings.Builder
+	add := func(name, value string) {
+		b.WriteString("/" + name)
+		if value == "" || strings.Contains(value, "/") {
+			b.WriteString("@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value)))
+			if value == "" {
+				b.WriteString("=")
+			}
+			return
+		}
+		b.WriteString("/" + url.PathEscape(value))
+	}
+	add("job", p.Job)
+	add("instance", p.Instance)
+	for _, name := range p.Grouping.Names() {
+		add(name, p.Grouping[name])
+	}
+	return "/metrics" + b.String()
+}
+
+// Run pushes on every tick of the interval and does not return.  Failed
+// pushes are logged and the next tick pushes fresh metrics.
+func (p *Pusher) Run() {
+	if p.http == nil {
+		p.http = &http.Client{Timeout: p.Interval}
+	}
+	log.Printf("Pushing to %s%s every %v\n", p.URL, p.groupingPath(), p.Interval)
+	for range tick(p.Interval) {
+		if err := p.Push(); err != nil {
+			log.Printf("push to %s: %v\n", p.URL, err)
+		}
+	}
+}
+
+// tick is a ticker which fires straight away as well.
+func tick(d time.Duration) <-chan time.Time {
+	c := make(chan time.Time, 1)
+	c <- time.Now()
+	go func() {
+		for t := range time.NewTicker(d).C {
+			select {
+			case c <- t:
+			default: // still busy with the last one
+			}
+		}
+	}()
+	return c
+}
+
+// Push collects once and sends the result, trying again on network errors
+// and server errors.  The Pushgateway refusing the metrics is not retried.
+// The samples go without timestamps, which the Pushgateway refuses.
+func (p *Pusher) Push() error {
+	m := Metrics{Client: p.Client, Format: FormatPrometheus}
+	body, err := m.CollectAll()
+	if err != nil {
+		return err
+	}
+
+	wait := pushRetryWait
+	for try := 0; ; try++ {
+		retry, err := p.put(body)
+		if err == nil || !retry || try >= p.Retries {
+			return err
+		}
+		log.Printf("push to %s: %v, trying again in %v\n", p.URL, err, wait)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// put sends the body once and reports whether a failure is worth retrying.
+func (p *Pusher) put(body string) (bool, error) {
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(p.URL, "/")+p.groupingPath(), strings.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", contentTypes[FormatPrometheus])
+	if p.User != "" || p.Password != "" {
+		req.SetBasicAuth(p.User, p.Password)
+	}
+	return sendRequest(p.http, req)
+}
+
+// sendRequest makes the request on the client, or the default client when
+// nil, and reports whether a failure is worth retrying: network errors,
+// server errors and 429 are, the server refusing what was sent is not.
+func sendRequest(client *http.Client, req *http.Request) (bool, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGroupingPath(t *testing.T) {
+	p := &Pusher{Job: "node", Instance: "web 1", Grouping: Labels{"path": "/var/tmp", "empty": ""}}
+	want := "/metrics/job/node/instance/web%201/empty@base64/=/path@base64/L3Zhci90bXA"
+	if got := p.groupingPath(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestPush(t *testing.T) {
+	fixtureLoadavg(t)
+	pushRetryWait = time.Millisecond
+	defer func() { pushRetryWait = time.Second }()
+
+	var calls int
+	var path, auth, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+		if calls == 1 {
+			http.Error(rw, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := io.ReadAll(req.Body)
+		path, body = req.Method+" "+req.URL.EscapedPath(), string(b)
+		user, pass, _ := req.BasicAuth()
+		auth = user + ":" + pass
+	}))
+	defer srv.Close()
+
+	p := &Pusher{URL: srv.URL + "/", Job: "node", Instance: "web1", User: "push", Password: "secret", Retries: 1}
+	if err := p.Push(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || path != "PUT /metrics/job/node/instance/web1" || auth != "push:secret" {
+		t.Errorf("calls %d, %s as %s", calls, path, auth)
+	}
+	if !strings.Contains(body, "node_load1 0.42\n") {
+		t.Errorf("body:\n%s", body)
+	}
+
+	// A refused push is not retried
+	calls = 0
+	srv.Config.Handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+		http.Error(rw, "inconsistent help", http.StatusBadRequest)
+	})
+	if err := p.Push(); err == nil || !strings.Contains(err.Error(), "inconsistent help") || calls != 1 {
+		t.Errorf("push refused: %v after %d calls", err, calls)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// maxSessions keeps the concurrent collectors under the MaxSessions limit
+// of a stock sshd.
+const maxSessions = 8
+
+// Host key checking modes for --ssh.host-key-check, named as for the
+// StrictHostKeyChecking option of OpenSSH.
+const (
+	HostKeyStrict    = "yes"
+	HostKeyAcceptNew = "accept-new"
+	HostKeyIgnore    = "no"
+)
+
+// hostKeyCheck and knownHostsFile are how the host keys of new clients are
+// checked, set with --ssh.host-key-check and --ssh.known-hosts.
+var (
+	hostKeyCheck   = HostKeyStrict
+	knownHostsFile = func() string {
+		home, _ := os.UserHomeDir()
+		return filepath.Join(home, ".ssh", "known_hosts")
+	}()
+)
+
+func validHostKeyCheck(mode string) bool {
+	return mode == HostKeyStrict || mode == HostKeyAcceptNew || mode == HostKeyIgnore
+}
+
+// knownHostsMu keeps the known_hosts file whole while hosts are added to it.
+var knownHostsMu sync.Mutex
+
+// hostKeyCallback checks host keys against the known_hosts file, which is
+// read again for every connection so keys added by hand or on first use are
+// picked up.  In accept-new mode the key of a host not in the file is added
+// to it; a key differing from the one on file is always refused.
+func hostKeyCallback(file, mode string) ssh.HostKeyCallback {
+	if mode == HostKeyIgnore {
+		return ssh.InsecureIgnoreHostKey()
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+
+		check, err := knownhosts.New(file)
+		if os.IsNotExist(err) {
+			check, err = func(string, net.Addr, ssh.PublicKey) error { return &knownhosts.KeyError{} }, nil
+		}
+		if err != nil {
+			return err
+		}
+		err = check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			return fmt.Errorf("host key for %s does not match the one in %s:%d: %v",
+				hostname, keyErr.Want[0].Filename, keyErr.Want[0].Line, err)
+		}
+		if mode != HostKeyAcceptNew {
+			return fmt.Errorf("host key for %s is not in %s: %v", hostname, file, err)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(f, knownhosts.Line([]string{hostname}, key))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			log.Printf("Added %s key of %s to %s\n", key.Type(), hostname, file)
+		}
+		return err
+	}
+}
+
+// knownAlgorithms lists the host key algorithms of the keys on file for the
+// address, so the server is asked for a key which can be checked rather than
+// whichever it prefers.
+func knownAlgorithms(file, addr string) []string {
+	knownHostsMu.Lock()
+	check, err := knownhosts.New(file)
+	knownHostsMu.Unlock()
+	if err != nil {
+		return nil
+	}
+	probe, _ := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	var keyErr *knownhosts.KeyError
+	if !errors.As(check(addr, &net.TCPAddr{}, probe), &keyErr) {
+		return nil
+	}
+	var algos []string
+	for _, k := range keyErr.Want {
+		if k.Key.Type() == ssh.KeyAlgoRSA {
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algos = append(algos, k.Key.Type())
+	}
+	return algos
+}
+
+// NewClient sets up a client for the target.  The public keys offered are
+// those of the private key, with its certificate when there is one, followed
+// by those of the ssh-agent on SSH_AUTH_SOCK; the password is tried last.
+// Nothing is dialed until the first command.
+func NewClient(t Target) (*Client, error) {
+	port := t.Port
+	if port == 0 {
+		port = 22
+	}
+	c := &Client{
+		Addr: net.JoinHostPort(t.Host, strconv.Itoa(port)),
+		Config: &ssh.ClientConfig{
+			User:            t.User,
+			HostKeyCallback: hostKeyCallback(knownHostsFile, hostKeyCheck),
+			Timeout:         8 * time.Second,
+		},
+		knownHosts: knownHostsFile,
+		sessions:   make(chan struct{}, maxSessions),
+	}
+	if hostKeyCheck == HostKeyIgnore {
+		c.knownHosts = ""
+	}
+
+	if t.Key != "" {
+		signers, err := loadKey(t.Key, t.Cert, t.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		c.keys = signers
+	} else if t.Cert != "" {
+		return nil, fmt.Errorf("certificate %s given without its private key", t.Cert)
+	}
+	if len(c.keys) > 0 || os.Getenv("SSH_AUTH_SOCK") != "" {
+		c.Config.Auth = append(c.Config.Auth, ssh.PublicKeysCallback(c.publicKeys))
+	}
+	if t.Pass != "" {
+		c.Config.Auth = append(c.Config.Auth, ssh.Password(t.Pass))
+	}
+	if t.Script != "" {
+		if _, err := os.Stat(t.Script); err != nil {
+			return nil, fmt.Errorf("unable to read script: %v", err)
+		}
+		c.scripts = []string{t.Script}
+	}
+	return c, nil
+}
+
+// loadKey reads a private key, decrypting it with the passphrase, and pairs
+// it with its OpenSSH certificate.  Without a certificate file named, the
+// one ssh-keygen -s writes next to the key is used when it exists.
+func loadKey(keyFile, certFile, passphrase string) ([]ssh.Signer, error) {
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read private key: %v", err)
+	}
+
+	// Create the Signer for this private key.
+	signer, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("private key %s is encrypted and no passphrase is set", keyFile)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key: %v", err)
+	}
+
+	if certFile == "" {
+		certFile = keyFile + "-cert.pub"
+		if _, err := os.Stat(certFile); err != nil {
+			return []ssh.Signer{signer}, nil
+		}
+	}
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificate: %v", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse certificate %s: %v", certFile, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", certFile)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s: %v", certFile, err)
+	}
+	return []ssh.Signer{certSigner, signer}, nil
+}
+
+// publicKeys is called during the handshake, under the lock held by connect,
+// which closes the agent connection once the handshake is over.  It may be
+// called more than once a handshake, so the connection is reused.
+func (c *Client) publicKeys() ([]ssh.Signer, error) {
+	signers := c.keys
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if c.agent == nil {
+			conn, err := net.Dial("unix", sock)
+			if err != nil {
+				log.Printf("ssh-agent on %s: %v\n", sock, err)
+				return signers, nil
+			}
+			c.agent = conn
+		}
+		agentSigners, err := agent.NewClient(c.agent).Signers()
+		if err != nil {
+			log.Printf("ssh-agent on %s: %v\n", sock, err)
+		}
+		signers = append(signers[:len(signers):len(signers)], agentSigners...)
+	}
+	return signers, nil
+}
+
+// envDefault returns the environment variable, or def when it is not set.
+func envDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// shellQuote quotes s for the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// remoteFS reads from a host over SSH with the plain tools found on any
+// appliance: cat, ls, stat and find.  Reads are given up when ctx, that of
+// the collector reading, is done.
+type remoteFS struct {
+	c   *Client
+	ctx context.Context
+}
+
+func (r remoteFS) context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+func (r remoteFS) withContext(ctx context.Context) FS {
+	r.ctx = ctx
+	return r
+}
+
+func (r remoteFS) ReadFile(name string) ([]byte, error) {
+	out, err := r.c.ExecuteContext(r.context(), "cat "+shellQuote(name))
+	if err != nil {
+		return nil, &os.PathError{Op: "read", Path: name, Err: err}
+	}
+	return []byte(out), nil
+}
+
+func (r remoteFS) ReadDir(name string) ([]string, error) {
+	out, err := r.c.ExecuteContext(r.context(), "ls -1A "+shellQuote(name))
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	// One name a line, as names may hold spaces
+	out = strings.TrimSuffix(out, "\n")
+	if out == "" {
+		return nil, nil
+	}
+	return strings.Split(out, "\n"), nil
+}
+
+func (r remoteFS) ModTime(name string) (time.Time, error) {
+	out, err := r.c.ExecuteContext(r.context(), "stat -c %Y "+shellQuote(name))
+	if err != nil {
+		return time.Time{}, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	sec, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return time.Time{}, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// Walk lists the tree with find, the directories first, and calls fn in
+// lexical order as filepath.Walk does.  Only the name and the directory bit
+// of the file info are filled in.
+func (r remoteFS) Walk(root string, fn filepath.WalkFunc) error {
+	q := shellQuote(root)
+	out, err := r.c.ExecuteContext(r.context(), "find "+q+" -type d; echo; find "+q+" ! -type d")
+	if err != nil && out == "" {
+		return fn(root, nil, err)
+	}
+
+	dirs, files, _ := strings.Cut(out, "\n\n")
+	isDir := make(map[string]bool)
+	var paths []string
+	for _, p := range strings.Split(dirs, "\n") {
+		if p != "" {
+			isDir[p] = true
+			paths = append(paths, p)
+		}
+	}
+	for _, p := range strings.Split(files, "\n") {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return walkPaths(paths, isDir, fn)
+}
+
+// walkPaths calls fn for each path in lexical order as filepath.Walk does,
+// skipping what is below a path for which fn returns filepath.SkipDir.
+func walkPaths(paths []string, isDir map[string]bool, fn filepath.WalkFunc) error {
+	sort.Strings(paths)
+
+	var skip string
+	for _, p := range paths {
+		if skip != "" && strings.HasPrefix(p, skip) {
+			continue
+		}
+		err := fn(p, remoteFileInfo{name: filepath.Base(p), dir: isDir[p]}, nil)
+		if err == filepath.SkipDir {
+			if isDir[p] {
+				skip = p + "/"
+			} else {
+				skip = filepath.Dir(p) + "/"
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Command runs the command on the host, under timeout(1) when the host has
+// it so the command does not outlive the collector.
+func (r remoteFS) Command(ctx context.Context, name string, arg ...string) ([]byte, error) {
+	if err := r.c.connect(); err != nil {
+		return nil, err
+	}
+	r.c.mu.Lock()
+	hasTimeout := r.c.hasTimeout
+	r.c.mu.Unlock()
+
+	words := make([]string, 0, len(arg)+3)
+	if deadline, ok := ctx.Deadline(); ok && hasTimeout {
+		secs := math.Ceil(time.Until(deadline).Seconds())
+		words = append(words, "timeout", strconv.Itoa(int(math.Max(secs, 1))))
+	}
+	words = append(words, shellQuote(name))
+	for _, a := range arg {
+		words = append(words, shellQuote(a))
+	}
+	out, err := r.c.ExecuteContext(ctx, strings.Join(words, " "))
+	return []byte(out), err
+}
+
+type remoteFileInfo struct {
+	name string
+	dir  bool
+}
+
+func (fi remoteFileInfo) Name() string { return fi.name }
+func (fi remoteFileInfo) Size() int64  { return 0 }
+func (fi remoteFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+func (fi remoteFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi remoteFileInfo) IsDir() bool        { return fi.dir }
+func (fi remoteFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startSSHServer runs an SSH server on the loopback which accepts the
+// password "secret" and runs each exec request with the local sh.  The
+// configure functions may add other ways in.
+func startSSHServer(t *testing.T, configure ...func(*ssh.ServerConfig)) (string, ssh.PublicKey) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if string(pass) != "secret" {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	for _, f := range configure {
+		f(config)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+	return ln.Addr().String(), signer.PublicKey()
+}
+
+// testTarget is the test server at addr, logged into with the password.
+// Host keys are recorded on first use in a known_hosts file of the test.
+func testTarget(t *testing.T, addr string) Target {
+	t.Helper()
+	useKnownHosts(t, HostKeyAcceptNew)
+	host, port, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(port)
+	return Target{Host: host, Port: n, User: "test", Pass: "secret"}
+}
+
+// useKnownHosts sets the host key checking of new clients, against an empty
+// known_hosts file, until the test ends.
+func useKnownHosts(t *testing.T, mode string) string {
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	oldFile, oldMode := knownHostsFile, hostKeyCheck
+	knownHostsFile, hostKeyCheck = file, mode
+	t.Cleanup(func() { knownHostsFile, hostKeyCheck = oldFile, oldMode })
+	return file
+}
+
+// sshExecs counts the commands run by the test servers.
+var sshExecs int32
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() == "direct-tcpip" {
+			go serveDirect(nc)
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range reqs {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				atomic.AddInt32(&sshExecs, 1)
+				n := binary.BigEndian.Uint32(req.Payload)
+				cmd := exec.Command("sh", "-c", string(req.Payload[4:4+n]))
+				cmd.Stdout = ch
+				status := make([]byte, 4)
+				if err := cmd.Run(); err != nil {
+					binary.BigEndian.PutUint32(status, uint32(cmd.ProcessState.ExitCode()))
+				}
+				ch.SendRequest("exit-status", false, status)
+				return
+			}
+		}()
+	}
+}
+
+// serveDirect connects a port forward to the address asked for.
+func serveDirect(nc ssh.NewChannel) {
+	var req struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &req); err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port))))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(conn, ch)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(ch, conn)
+	ch.Close()
+	conn.Close()
+}
+
+func TestRemoteFS(t *testing.T) {
+	addr, _ := startSSHServer(t)
+	c, err := NewClient(testTarget(t, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := remoteFS{c: c}
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "it's here")
+	os.WriteFile(name, []byte("hello\n"), 0644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "sub", "memory.stat"), nil, 0644)
+
+	if b, err := r.ReadFile(name); err != nil || string(b) != "hello\n" {
+		t.Errorf("ReadFile = %q, %v", b, err)
+	}
+	if _, err := r.ReadFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("ReadFile of a missing file did not fail")
+	}
+	if names, err := r.ReadDir(filepath.Join(dir, "sub")); err != nil || strings.Join(names, ",") != "memory.stat" {
+		t.Errorf("ReadDir = %q, %v", names, err)
+	}
+	if names, err := r.ReadDir(dir); err != nil || strings.Join(names, ",") != "it's here,sub" {
+		t.Errorf("ReadDir = %q, %v", names, err)
+	}
+
+	var walked []string
+	err = r.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(dir, path)
+		if info.IsDir() {
+			rel += "/"
+		}
+		walked = append(walked, rel)
+		return err
+	})
+	if got := strings.Join(walked, ","); err != nil || got != "./,it's here,sub/,sub/memory.stat" {
+		t.Errorf("Walk = %s, %v", got, err)
+	}
+
+	out, err := r.Command(context.Background(), "echo", "a b", "$HOME")
+	if err != nil || string(out) != "a b $HOME\n" {
+		t.Errorf("Command = %q, %v", out, err)
+	}
+}
+
+// Reads going to the host must be given up with the collector doing them.
+func TestRemoteFSContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &Client{}
+	for _, fs := range []FS{nil, remoteFS{c: c}, newBatchFS(remoteFS{c: c}, nil, nil)} {
+		m := &Metrics{Client: c, FS: fs, ctx: ctx}
+		got := m.fs()
+		if b, ok := got.(*batchFS); ok {
+			got = b.FS
+		}
+		if r, ok := got.(remoteFS); !ok || r.ctx != ctx {
+			t.Errorf("fs() of %T reads with %v", fs, got)
+		}
+	}
+}
+
+// A batch read must answer as the local filesystem would, after one
+// round-trip.
+func TestBatchFS(t *testing.T) {
+	addr, _ := startSSHServer(t)
+	c, err := NewClient(testTarget(t, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	write := func(name, s string) {
+		name = filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(name), 0755)
+		os.WriteFile(name, []byte(s), 0644)
+	}
+	write("loadavg", "0.1 0.2 0.3\n\nlast: line\n")
+	write("empty", "")
+	write("text/a.prom", "a 1\n")
+	write("text/b.prom", "b 2\n")
+	write("text/c.txt", "c 3\n")
+	write("cg/memory.stat", "cache 1\n")
+	write("cg/docker/ab:c/memory.stat", "cache 2\n")
+	write("cg/docker/ab:c/memory.swappiness", "60\n")
+	write("cg/docker/ab:c/cgroup.procs", "1\n")
+	write("cg/user/other", "x\n")
+
+	files := []string{
+		filepath.Join(dir, "loadavg"),
+		filepath.Join(dir, "empty"),
+		filepath.Join(dir, "missing"),
+		filepath.Join(dir, "text/*.prom"),
+		filepath.Join(dir, "nodir/*.prom"),
+	}
+	trees := map[string][]string{
+		filepath.Join(dir, "cg"):       {"memory.stat", "memory.swappiness", "memory.usage_in_bytes"},
+		filepath.Join(dir, "nocgroup"): {"cpu.shares"},
+	}
+	if err := c.connect(); err != nil {
+		t.Fatal(err)
+	}
+	b := newBatchFS(remoteFS{c: c}, files, trees)
+	before := atomic.LoadInt32(&sshExecs)
+	out, err := c.Execute(b.script())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.parse(out)
+	if n := atomic.LoadInt32(&sshExecs) - before; n != 1 {
+		t.Errorf("batch read took %d commands", n)
+	}
+	before = atomic.LoadInt32(&sshExecs)
+
+	for _, name := range []string{
+		"loadavg", "empty", "missing", "text/a.prom", "text/c.txt",
+		"cg/docker/ab:c/memory.stat", "cg/docker/ab:c/memory.swappiness", "cg/docker/ab:c/memory.usage_in_bytes",
+	} {
+		name = filepath.Join(dir, name)
+		want, werr := LocalFS{}.ReadFile(name)
+		got, err := b.ReadFile(name)
+		if string(got) != string(want) || (err == nil) != (werr == nil) || err != nil && !os.IsNotExist(err) {
+			t.Errorf("ReadFile(%s) = %q, %v; want %q, %v", name, got, err, want, werr)
+		}
+		wantT, _ := LocalFS{}.ModTime(name)
+		if gotT, _ := b.ModTime(name); !gotT.Equal(wantT.Truncate(time.Second)) {
+			t.Errorf("ModTime(%s) = %v, want %v", name, gotT, wantT)
+		}
+	}
+
+	if names, err := b.ReadDir(filepath.Join(dir, "text")); err != nil || strings.Join(names, ",") != "a.prom,b.prom" {
+		t.Errorf("ReadDir = %q, %v", names, err)
+	}
+	if _, err := b.ReadDir(filepath.Join(dir, "nodir")); !os.IsNotExist(err) {
+		t.Errorf("ReadDir of a missing directory = %v", err)
+	}
+
+	walk := func(root string) string {
+		var walked []string
+		err := b.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(root, path)
+			if info.IsDir() {
+				rel += "/"
+			}
+			walked = append(walked, rel)
+			return nil
+		})
+		if err != nil {
+			walked = append(walked, err.Error())
+		}
+		return strings.Join(walked, ",")
+	}
+	if got := walk(filepath.Join(dir, "cg")); got != "./,docker/,docker/ab:c/,docker/ab:c/memory.stat,docker/ab:c/memory.swappiness,memory.stat" {
+		t.Errorf("Walk = %s", got)
+	}
+	if got := walk(filepath.Join(dir, "nocgroup")); !strings.Contains(got, "not exist") {
+		t.Errorf("Walk of a missing tree = %s", got)
+	}
+	if n := atomic.LoadInt32(&sshExecs) - before; n != 2 {
+		t.Errorf("reads after the batch took %d commands", n) // only for text/c.txt
+	}
+}
+
+func TestHostKeyCheck(t *testing.T) {
+	addr, hostKey := startSSHServer(t)
+	target := testTarget(t, addr)
+	connect := func() error {
+		c, err := NewClient(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.connect()
+	}
+
+	file := useKnownHosts(t, HostKeyStrict)
+	if err := connect(); err == nil || !strings.Contains(err.Error(), "is not in") {
+		t.Errorf("unknown host in strict mode: %v", err)
+	}
+
+	hostKeyCheck = HostKeyAcceptNew
+	if err := connect(); err != nil {
+		t.Fatalf("new host in accept-new mode: %v", err)
+	}
+	b, _ := os.ReadFile(file)
+	if !strings.Contains(string(b), string(ssh.MarshalAuthorizedKey(hostKey))) {
+		t.Errorf("host key was not recorded: %s", b)
+	}
+
+	hostKeyCheck = HostKeyStrict
+	if err := connect(); err != nil {
+		t.Errorf("recorded host in strict mode: %v", err)
+	}
+
+	// Another server claiming to be the first
+	other, _ := startSSHServer(t)
+	target = testTarget(t, other)
+	line := knownhosts.Line([]string{other}, hostKey)
+	os.WriteFile(knownHostsFile, []byte(line+"\n"), 0600)
+	if err := connect(); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("changed host key: %v", err)
+	}
+}
+
+// authorize lets the key in to the test server.
+func authorize(key ssh.PublicKey) func(*ssh.ServerConfig) {
+	return func(config *ssh.ServerConfig) {
+		config.PublicKeyCallback = func(c ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(k.Marshal(), key.Marshal()) {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		}
+	}
+}
+
+func TestAgentAuth(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var dials int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&dials, 1)
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	pub, _ := ssh.NewPublicKey(key.Public())
+	addr, _ := startSSHServer(t, authorize(pub))
+	target := testTarget(t, addr)
+	target.Pass = ""
+	c, err := NewClient(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := c.Execute("echo ok"); err != nil || out != "ok\n" {
+		t.Errorf("Execute = %q, %v", out, err)
+	}
+
+	// Asked again within a handshake, the agent is not dialed again
+	before := atomic.LoadInt32(&dials)
+	for i := 0; i < 2; i++ {
+		if signers, err := c.publicKeys(); err != nil || len(signers) == 0 {
+			t.Fatalf("publicKeys = %v, %v", signers, err)
+		}
+	}
+	c.agent.Close()
+	if n := atomic.LoadInt32(&dials) - before; n != 1 {
+		t.Errorf("agent dialed %d times, want 1", n)
+	}
+}
+
+// An encrypted key with a certificate next to it, as ssh-keygen -s leaves.
+func TestCertAuth(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca, _ := ssh.NewSignerFromKey(caKey)
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	pub, _ := ssh.NewPublicKey(key.Public())
+
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("letmein"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: []string{"test"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(keyFile+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0644)
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+	}
+	addr, _ := startSSHServer(t, func(config *ssh.ServerConfig) {
+		config.PublicKeyCallback = checker.Authenticate
+	})
+	target := testTarget(t, addr)
+	target.Pass = ""
+	target.Key = keyFile
+
+	if _, err := NewClient(target); err == nil || !strings.Contains(err.Error(), "encrypted") {
+		t.Errorf("encrypted key without a passphrase: %v", err)
+	}
+	target.Passphrase = "letmein"
+	c, err := NewClient(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := c.Execute("echo ok"); err != nil || out != "ok\n" {
+		t.Errorf("Execute = %q, %v", out, err)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// RemoteWriter collects on an interval and ships the samples with the
+// Prometheus remote_write protocol.  Each collection is kept in a file of the
+// queue directory until it has been sent, so samples taken while the link is
+// down go out later with the time they were taken.  When the queue grows past
+// MaxBytes the oldest collections are dropped.
+type RemoteWriter struct {
+	URL      string
+	User     string
+	Password string
+	Interval time.Duration
+	Dir      string
+	MaxBytes int64
+	Labels   Labels // added to series which do not have them
+	Client   *Client
+
+	http *http.Client
+}
+
+// metricTypeValues are the MetricMetadata.MetricType values of remote_write.
+var metricTypeValues = map[string]uint64{
+	"untyped": 0, "counter": 1, "gauge": 2, "histogram": 3, "summary": 5,
+}
+
+// writeRequest encodes the families as a remote_write WriteRequest, with the
+// samples lacking a timestamp given ts.
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; repeated MetricMetadata metadata = 3; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+//	message MetricMetadata { MetricType type = 1; string metric_family_name = 2; string help = 4; string unit = 5; }
+func writeRequest(fams []*Family, ts int64, extra Labels) []byte {
+	var b protoBuf
+	for _, f := range fams {
+		for _, s := range f.Samples {
+			name := f.Name
+			if s.Name != "" {
+				name = s.Name
+			}
+			labels := extra.With(s.Labels)
+			labels["__name__"] = name
+			b.message(1, func(b *protoBuf) {
+				for _, n := range labels.Names() {
+					b.message(1, func(b *protoBuf) {
+						b.string(1, n)
+						b.string(2, labels[n])
+					})
+				}
+				b.message(2, func(b *protoBuf) {
+					b.double(1, s.Value)
+					if s.Timestamp != 0 {
+						b.int64(2, s.Timestamp)
+					} else {
+						b.int64(2, ts)
+					}
+				})
+			})
+		}
+	}
+	for _, f := range fams {
+		b.message(3, func(b *protoBuf) {
+			b.varint(1, metricTypeValues[f.Type])
+			b.string(2, f.Name)
+			b.string(4, f.Help)
+			b.string(5, metricUnit(f.Name))
+		})
+	}
+	return b
+}
+
+// Run collects and sends on every tick of the interval and does not return.
+func (w *RemoteWriter) Run() {
+	if w.http == nil {
+		w.http = &http.Client{Timeout: w.Interval}
+	}
+	if err := os.MkdirAll(w.Dir, 0700); err != nil {
+		log.Fatalf("remote write queue: %v", err)
+	}
+	log.Printf("Writing to %s every %v, queueing in %s\n", w.URL, w.Interval, w.Dir)
+	for range tick(w.Interval) {
+		if err := w.Collect(); err != nil {
+			log.Printf("remote write: %v\n", err)
+		}
+		if err := w.Flush(); err != nil {
+			log.Printf("remote write to %s: %v\n", w.URL, err)
+		}
+	}
+}
+
+// Collect takes the metrics and puts them on the queue.
+func (w *RemoteWriter) Collect() error {
+	now := time.Now()
+	m := Metrics{Client: w.Client, Format: FormatPrometheus, Timestamp: now.UnixNano() / 1e6}
+	_, err := m.CollectAll()
+	fams := m.Families()
+	if err != nil {
+		return err
+	}
+	return w.enqueue(fmt.Sprintf("%020d", now.UnixNano()), snappy.Encode(nil, writeRequest(fams, m.Timestamp, w.Labels)))
+}
+
+// queue lists the files waiting to be sent, oldest first.
+func (w *RemoteWriter) queue() ([]string, error) {
+	names, err := LocalFS{}.ReadDir(w.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range names {
+		if strings.HasSuffix(name, ".snappy") {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// enqueue writes the request to the queue, in a temporary file renamed in
+// place so a crash cannot leave half a request to be sent, then drops the
+// oldest files until the queue fits in MaxBytes again.
+func (w *RemoteWriter) enqueue(name string, data []byte) error {
+	file := filepath.Join(w.Dir, name+".snappy")
+	if err := os.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return err
+	}
+
+	files, err := w.queue()
+	if err != nil {
+		return err
+	}
+	var total int64
+	sizes := make([]int64, len(files))
+	for i, f := range files {
+		if fi, err := os.Stat(filepath.Join(w.Dir, f)); err == nil {
+			sizes[i] = fi.Size()
+			total += sizes[i]
+		}
+	}
+	for i := 0; total > w.MaxBytes && i < len(files)-1; i++ {
+		log.Printf("remote write queue is over %d bytes, dropping %s\n", w.MaxBytes, files[i])
+		os.Remove(filepath.Join(w.Dir, files[i]))
+		total -= sizes[i]
+	}
+	return nil
+}
+
+// Flush sends the queue in order until it is empty or a send fails in a way
+// worth trying again later.  A request the server refuses is dropped, as it
+// would be refused again.
+func (w *RemoteWriter) Flush() error {
+	files, err := w.queue()
+	if err != nil {
+		return err
+	}
+	for i, f := range files {
+		file := filepath.Join(w.Dir, f)
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		retry, err := w.send(data)
+		if err != nil && retry {
+			return fmt.Errorf("%v, %d requests queued", err, len(files)-i)
+		}
+		if err != nil {
+			log.Printf("remote write of %s refused, dropping it: %v\n", f, err)
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send posts one request and reports whether a failure is worth retrying.
+func (w *RemoteWriter) send(data []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("User-Agent", "node-stats/"+version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.User != "" || w.Password != "" {
+		req.SetBasicAuth(w.User, w.Password)
+	}
+	return sendRequest(w.http, req)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// protoFields decodes one level of a protocol buffer message into its fields,
+// with varints and fixed64 values as numbers and the rest as bytes.
+func protoFields(t *testing.T, b []byte) map[int][]interface{} {
+	t.Helper()
+	fields := map[int][]interface{}{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(b)
+			fields[field] = append(fields[field], v)
+			b = b[n:]
+		case wireFixed64:
+			fields[field] = append(fields[field], math.Float64frombits(binary.LittleEndian.Uint64(b)))
+			b = b[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			fields[field] = append(fields[field], b[n:n+int(l)])
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+// writtenSeries decodes a WriteRequest into the series as text and the
+// timestamps of their samples.
+func writtenSeries(t *testing.T, req []byte) (series []string, times []int64) {
+	t.Helper()
+	for _, ts := range protoFields(t, req)[1] {
+		f := protoFields(t, ts.([]byte))
+		var labels []string
+		for _, l := range f[1] {
+			lf := protoFields(t, l.([]byte))
+			labels = append(labels, string(lf[1][0].([]byte))+"="+string(lf[2][0].([]byte)))
+		}
+		series = append(series, strings.Join(labels, ","))
+		sample := protoFields(t, f[2][0].([]byte))
+		times = append(times, int64(sample[2][0].(uint64)))
+	}
+	return
+}
+
+func TestWriteRequest(t *testing.T) {
+	fams := []*Family{{Name: "node_load1", Type: "gauge", Help: "1m load average.", Samples: []Sample{
+		{Labels: Labels{"cpu": "0"}, Value: 0.5},
+		{Value: 1, Timestamp: 1000},
+	}}}
+	series, times := writtenSeries(t, writeRequest(fams, 2000, Labels{"job": "node", "cpu": "all"}))
+	want := []string{"__name__=node_load1,cpu=0,job=node", "__name__=node_load1,cpu=all,job=node"}
+	if strings.Join(series, " ") != strings.Join(want, " ") || times[0] != 2000 || times[1] != 1000 {
+		t.Errorf("series %q at %v, want %q at [2000 1000]", series, times, want)
+	}
+	meta := protoFields(t, protoFields(t, writeRequest(fams, 0, nil))[3][0].([]byte))
+	if meta[1][0].(uint64) != 2 || string(meta[2][0].([]byte)) != "node_load1" || string(meta[4][0].([]byte)) != "1m load average." {
+		t.Errorf("metadata %v", meta)
+	}
+}
+
+func TestRemoteWrite(t *testing.T) {
+	fixtureLoadavg(t)
+
+	down := true
+	var received [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if down {
+			http.Error(rw, "down", http.StatusServiceUnavailable)
+			return
+		}
+		if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(rw, "bad headers", http.StatusBadRequest)
+			return
+		}
+		b, _ := io.ReadAll(req.Body)
+		data, err := snappy.Decode(nil, b)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received = append(received, data)
+	}))
+	defer srv.Close()
+
+	w := &RemoteWriter{URL: srv.URL, Dir: t.TempDir(), MaxBytes: 1 << 20, Labels: Labels{"job": "node"}}
+	for i := 0; i < 2; i++ {
+		if err := w.Collect(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err == nil || !strings.Contains(err.Error(), fmt.Sprintf("%d requests queued", i+1)) {
+			t.Fatalf("flush while down: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	// Once up the queue goes out in order with the times of collection
+	down = false
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 2 {
+		t.Fatalf("received %d requests, want 2", len(received))
+	}
+	series, first := writtenSeries(t, received[0])
+	_, second := writtenSeries(t, received[1])
+	if !strings.Contains(strings.Join(series, " "), "__name__=node_load1,job=node") || first[0] >= second[0] {
+		t.Errorf("series %q at %v then %v", series, first, second)
+	}
+	if files, _ := w.queue(); len(files) != 0 {
+		t.Errorf("queue left %v", files)
+	}
+
+	// A refused request is dropped rather than blocking the queue
+	srv.Config.Handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "out of order", http.StatusBadRequest)
+	})
+	w.Collect()
+	if err := w.Flush(); err != nil {
+		t.Errorf("refused flush: %v", err)
+	}
+	if files, _ := w.queue(); len(files) != 0 {
+		t.Errorf("queue left %v", files)
+	}
+}
+
+func TestRemoteWriteQueueLimit(t *testing.T) {
+	w := &RemoteWriter{Dir: t.TempDir(), MaxBytes: 250}
+	for _, name := range []string{"1", "2", "3"} {
+		if err := w.enqueue(name, make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files, _ := w.queue(); strings.Join(files, " ") != "2.snappy 3.snappy" {
+		t.Errorf("queue %v, want the newest two", files)
+	}
+
+	// The newest is kept even when it alone is over the limit
+	w.MaxBytes = 10
+	w.enqueue("4", make([]byte, 100))
+	if files, _ := w.queue(); strings.Join(files, " ") != "4.snappy" {
+		t.Errorf("queue %v, want only the newest", files)
+	}
+	if _, err := os.Stat(filepath.Join(w.Dir, "4.snappy.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary file left: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// scriptFiles are run on every scrape, set with --collector.script.file.
+// Targets from the config file may add one of their own.
+var scriptFiles []string
+
+// scriptGrace is kept back from the collector deadline when the scripts are
+// killed, so the collector can still report on those which ran over.
+const scriptGrace = 500 * time.Millisecond
+
+// scriptResult is the output of one script and how it ended.  The exit code
+// is -1 when the script did not run to the end.
+type scriptResult struct {
+	file     string
+	out      []byte
+	code     int
+	duration time.Duration
+	err      error
+}
+
+// CollectScript runs the scripts side by side and merges what they print,
+// which must be in the text exposition format.  The scripts are read from the
+// local disk; when collecting over SSH they are run on the remote host, under
+// timeout(1) when it has one.  The output of a script which does not parse,
+// carries timestamps, clashes with another script or does not finish in time
+// is left out whole, so a broken check cannot spoil the rest of the scrape.
+func (m *Metrics) CollectScript() error {
+	all := scriptFiles
+	if m.Client != nil {
+		all = append(all[:len(all):len(all)], m.Client.scripts...)
+	}
+	var files []string
+	seen := make(map[string]bool)
+	for _, file := range all {
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	ctx := m.context()
+	if deadline, ok := ctx.Deadline(); ok {
+		grace := scriptGrace
+		if left := time.Until(deadline); grace > left/4 {
+			grace = left / 4
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-grace))
+		defer cancel()
+	}
+
+	results := make([]scriptResult, len(files))
+	var wg sync.WaitGroup
+	for i, file := range files {
+		wg.Add(1)
+		go func(i int, file string) {
+			defer wg.Done()
+			results[i] = m.runScript(ctx, file)
+		}(i, file)
+	}
+	wg.Wait()
+
+	types := make(map[string]string)
+	series := make(map[string]bool)
+	success := make(map[string]bool)
+	for _, r := range results {
+		err := r.err
+		if err == nil {
+			var fams []*Family
+			if fams, err = ParseText(string(r.out)); err == nil {
+				if err = checkFamilies(fams, types, series, "script"); err == nil {
+					m.addFamilies(fams, types, series)
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("script %s: %v", r.file, err)
+		}
+		success[r.file] = err == nil && r.code == 0
+	}
+
+	m.PrintType("node_script_success", "gauge", "1 if the script exited with 0 and its output was used")
+	for _, r := range results {
+		m.PrintBool(Labels{"script": r.file}, success[r.file])
+	}
+	m.PrintType("node_script_duration_seconds", "gauge", "Time the script ran for")
+	for _, r := range results {
+		m.PrintFloat(Labels{"script": r.file}, r.duration.Seconds())
+	}
+	m.PrintType("node_script_exit_code", "gauge", "Exit code of the script, -1 when it was killed or could not be started")
+	for _, r := range results {
+		m.PrintInt(Labels{"script": r.file}, int64(r.code))
+	}
+	return nil
+}
+
+// runScript runs the script with sh on the host being collected from.  A
+// non-zero exit is not an error: the output is still used when it parses.
+func (m *Metrics) runScript(ctx context.Context, file string) scriptResult {
+	r := scriptResult{file: file, code: -1}
+	start := time.Now()
+	if m.Client == nil {
+		r.out, r.err = LocalFS{}.Command(ctx, "sh", file)
+	} else {
+		var data []byte
+		if data, r.err = os.ReadFile(file); r.err == nil {
+			r.out, r.err = remoteFS{c: m.Client}.Command(ctx, "sh", "-c", string(data))
+		}
+	}
+	r.duration = time.Since(start)
+
+	var exitErr *exec.ExitError
+	var sshErr *ssh.ExitError
+	switch {
+	case ctx.Err() != nil:
+		r.err = fmt.Errorf("killed after %v", r.duration.Round(time.Millisecond))
+	case r.err == nil:
+		r.code = 0
+	case errors.As(r.err, &exitErr) && exitErr.ExitCode() >= 0:
+		r.code, r.err = exitErr.ExitCode(), nil
+	case errors.As(r.err, &sshErr):
+		r.code, r.err = sshErr.ExitStatus(), nil
+	}
+	return r
+}
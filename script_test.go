@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeScripts puts the scripts in a temporary directory and returns their
+// paths in the same order.
+func writeScripts(t *testing.T, scripts ...string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	var files []string
+	for i, s := range scripts {
+		file := filepath.Join(dir, string(rune('a'+i))+".sh")
+		if err := os.WriteFile(file, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+func checkScriptOutput(t *testing.T, got string, want []string, unwanted []string) {
+	t.Helper()
+	for _, w := range want {
+		if !strings.Contains(got, w) {
+			t.Errorf("missing %q in:\n%s", w, got)
+		}
+	}
+	for _, w := range unwanted {
+		if strings.Contains(got, w) {
+			t.Errorf("unexpected %q in:\n%s", w, got)
+		}
+	}
+}
+
+func TestCollectScript(t *testing.T) {
+	files := writeScripts(t,
+		"echo '# TYPE check_ok gauge'; echo 'check_ok 1'",
+		"echo 'check_failed 1'; exit 3",
+		"echo 'check_garbage {'",
+		"echo 'check_ok 2'",
+		"echo 'check_slow 1'; sleep 10",
+	)
+	saved := scriptFiles
+	defer func() { scriptFiles = saved }()
+	scriptFiles = files
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	m := &Metrics{ctx: ctx}
+	if err := m.CollectScript(); err != nil {
+		t.Fatal(err)
+	}
+	checkScriptOutput(t, m.String(), []string{
+		"check_ok 1\n",
+		"check_failed 1\n",
+		`node_script_success{script="` + files[0] + `"} 1`,
+		`node_script_success{script="` + files[1] + `"} 0`,
+		`node_script_exit_code{script="` + files[1] + `"} 3`,
+		`node_script_success{script="` + files[2] + `"} 0`,
+		`node_script_exit_code{script="` + files[2] + `"} 0`,
+		`node_script_success{script="` + files[3] + `"} 0`,
+		`node_script_success{script="` + files[4] + `"} 0`,
+		`node_script_exit_code{script="` + files[4] + `"} -1`,
+	}, []string{"check_garbage", "check_ok 2", "check_slow"})
+}
+
+func TestCollectScriptRemote(t *testing.T) {
+	files := writeScripts(t, "echo \"check_remote{shell=\\\"$0\\\"} 1\"", "exit 2")
+	saved := scriptFiles
+	defer func() { scriptFiles = saved }()
+	scriptFiles = files[:1]
+
+	addr, _ := startSSHServer(t)
+	target := testTarget(t, addr)
+	target.Script = files[1]
+	c, err := NewClient(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Metrics{Client: c, FS: remoteFS{c: c}}
+	if err := m.CollectScript(); err != nil {
+		t.Fatal(err)
+	}
+	checkScriptOutput(t, m.String(), []string{
+		`check_remote{shell="sh"} 1`,
+		`node_script_success{script="` + files[0] + `"} 1`,
+		`node_script_exit_code{script="` + files[1] + `"} 2`,
+	}, nil)
+}
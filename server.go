@@ -0,0 +1,116 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const indexPage = `<html>
+<head><title>Node Stats</title></head>
+<body>
+<h1>Node Stats</h1>
+<p><a href="%s">Metrics</a></p>
+%s</body>
+</html>
+`
+
+func metricsHandler(format string, includeTime bool, client *Client) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		// A scraper which hangs up takes the collection with it
+		m := Metrics{Client: client, Format: negotiateFormat(req.Header.Get("Accept"), format), ctx: req.Context()}
+		if includeTime {
+			m.Timestamp = time.Now().UnixNano() / 1e6
+		}
+		s, err := m.CollectAll()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		rw.Header().Set("Content-Type", contentTypes[m.Format])
+		if acceptsGzip(req.Header.Get("Accept-Encoding")) {
+			rw.Header().Set("Content-Encoding", "gzip")
+			rw.WriteHeader(http.StatusOK)
+			w := gzip.NewWriter(rw)
+			io.WriteString(w, s)
+			w.Close()
+		} else {
+			io.WriteString(rw, s)
+		}
+	}
+}
+
+// acceptsGzip reads an Accept-Encoding header: gzip is accepted when it is
+// named with a q-value above zero, or when it is not named and * is.
+func acceptsGzip(header string) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		switch value, _, q := acceptItem(part); strings.ToLower(value) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	return gzipQ > 0 || gzipQ < 0 && anyQ > 0
+}
+
+// probeHandler collects from the target named in the query, in the manner
+// of the blackbox exporter:
+//
+//	/probe?target=web1
+func probeHandler(format string, includeTime bool, targets map[string]*Client) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		name := req.URL.Query().Get("target")
+		if name == "" {
+			http.Error(rw, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+		client, ok := targets[name]
+		if !ok {
+			http.Error(rw, fmt.Sprintf("unknown target %q", name), http.StatusNotFound)
+			return
+		}
+		metricsHandler(format, includeTime, client)(rw, req)
+	}
+}
+
+// Serve answers scrapes on the listen address, collecting from the host of
+// the client when there is one.  The targets, when given, are served on
+// /probe.
+func Serve(listen, metricsPath, format string, includeTime bool, client *Client, targets map[string]*Client) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, metricsHandler(format, includeTime, client))
+	var probes string
+	if targets != nil {
+		mux.HandleFunc("/probe", probeHandler(format, includeTime, targets))
+		for _, name := range sortedKeys(targets) {
+			probes += fmt.Sprintf("<p><a href=\"/probe?target=%s\">Probe %s</a></p>\n", url.QueryEscape(name), html.EscapeString(name))
+		}
+	}
+	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(rw, indexPage, metricsPath, probes)
+	})
+
+	if targets != nil {
+		setTitle(fmt.Sprintf("node-stats: probing %d targets, listening %s", len(targets), listen))
+	} else if client != nil {
+		setTitle(fmt.Sprintf("node-stats: [%s@%s] listening %s", client.Config.User, client.Addr, listen))
+	} else {
+		setTitle(fmt.Sprintf("node-stats: listening %s", listen))
+	}
+	log.Printf("Listening on %s, serving metrics on %s\n", listen, metricsPath)
+	return http.ListenAndServe(listen, mux)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+// textfileDirectory is where batch jobs leave their *.prom files, set with
+// --collector.textfile.directory.  Nothing is read when it is empty.
+var textfileDirectory string
+
+// CollectTextfile merges the metrics written by other programs into the
+// scrape, in the same way as the node_exporter textfile collector.  A file
+// which does not parse, carries timestamps or disagrees with another file on
+// the type of a family is left out whole and flagged in
+// node_textfile_scrape_error.
+func (m *Metrics) CollectTextfile() error {
+	if textfileDirectory == "" {
+		return nil
+	}
+
+	scrapeError := false
+	defer func() {
+		m.PrintType("node_textfile_scrape_error", "gauge", "1 if there was an error opening or reading a file, 0 otherwise")
+		m.PrintBool(nil, scrapeError)
+	}()
+
+	names, err := m.fs().ReadDir(textfileDirectory)
+	if err != nil {
+		scrapeError = true
+		return err
+	}
+	sort.Strings(names)
+
+	types := make(map[string]string)
+	series := make(map[string]bool)
+	mtimes := make(map[string]float64)
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".prom") {
+			continue
+		}
+		file := path.Join(textfileDirectory, name)
+		fams, err := m.readTextfile(file, types, series)
+		if err != nil {
+			log.Printf("textfile %s: %v", file, err)
+			scrapeError = true
+			continue
+		}
+		mtime, err := m.fs().ModTime(file)
+		if err != nil {
+			log.Printf("textfile %s: %v", file, err)
+			scrapeError = true
+			continue
+		}
+
+		m.addFamilies(fams, types, series)
+		mtimes[file] = float64(mtime.UnixNano()) / 1e9
+	}
+
+	m.PrintType("node_textfile_mtime_seconds", "gauge", "Unixtime mtime of textfiles successfully read")
+	for _, file := range sortedKeys(mtimes) {
+		m.PrintFloat(Labels{"file": file}, mtimes[file])
+	}
+	return nil
+}
+
+func sampleKey(f *Family, s Sample) string {
+	name := f.Name
+	if s.Name != "" {
+		name = s.Name
+	}
+	return name + "\x00" + s.Labels.key()
+}
+
+// readTextfile parses one file and checks it against the families and series
+// already taken from the others.
+func (m *Metrics) readTextfile(file string, types map[string]string, series map[string]bool) ([]*Family, error) {
+	s, err := m.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	fams, err := ParseText(s)
+	if err != nil {
+		return nil, err
+	}
+	return fams, checkFamilies(fams, types, series, "file")
+}
+
+// checkFamilies makes sure parsed families can be merged with those taken
+// from the other files or scripts, and carry no timestamps of their own.
+func checkFamilies(fams []*Family, types map[string]string, series map[string]bool, other string) error {
+	for _, f := range fams {
+		if typ, ok := types[f.Name]; ok && typ != f.Type {
+			return fmt.Errorf("%s is a %s here and a %s in another %s", f.Name, f.Type, typ, other)
+		}
+		for _, s := range f.Samples {
+			if s.Timestamp != 0 {
+				return fmt.Errorf("%s has a timestamp, which is not supported", f.Name)
+			}
+			if series[sampleKey(f, s)] {
+				return fmt.Errorf("%s%s is also in another %s", f.Name, formatLabels(s.Labels), other)
+			}
+		}
+	}
+	return nil
+}
+
+// addFamilies adds checked families to the output and records them for the
+// checks of those which follow.
+func (m *Metrics) addFamilies(fams []*Family, types map[string]string, series map[string]bool) {
+	for _, f := range fams {
+		types[f.Name] = f.Type
+		tf := m.family(f.Name, f.Type, f.Help)
+		for _, s := range f.Samples {
+			series[sampleKey(f, s)] = true
+			s.Timestamp = m.Timestamp
+			tf.Samples = append(tf.Samples, s)
+		}
+	}
+}
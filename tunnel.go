@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The wait before dialing a host or listening again after a failure doubles
+// from tunnelBackoffMin up to tunnelBackoffMax.  It goes back to the start
+// once a connection has stayed up for tunnelStable, so a host which accepts
+// and drops straight away is not dialed over and over.
+var (
+	tunnelBackoffMin = time.Second
+	tunnelBackoffMax = time.Minute
+	tunnelStable     = 30 * time.Second
+)
+
+// The wait after a temporary Accept error, such as running out of file
+// descriptors, doubles up to acceptDelayMax as net/http's does.
+const (
+	acceptDelayMin = 5 * time.Millisecond
+	acceptDelayMax = time.Second
+)
+
+// Tunnel forwards the connections made to a local address on to a remote
+// address reached from an SSH host, so an exporter behind a bastion can be
+// scraped.  The SSH connection is kept up, and dialed again when it drops.
+type Tunnel struct {
+	Name   string
+	Local  string
+	Remote string
+
+	client *Client
+	done   chan struct{}
+
+	mu        sync.Mutex
+	listener  net.Listener
+	listenErr error
+	up        bool
+	err       error // why the SSH connection is down
+
+	connects, accepted, failed, active, sent, received int64
+}
+
+// tunnels are those started from the config file, which the tunnel
+// collector reports on.
+var (
+	tunnelsMu sync.Mutex
+	tunnels   []*Tunnel
+)
+
+// NewTunnel sets up the tunnel for a forward entry of the config file.
+func NewTunnel(f Forward) (*Tunnel, error) {
+	client, err := NewClient(f.Target)
+	if err != nil {
+		return nil, err
+	}
+	local := f.Local
+	if !strings.Contains(local, ":") {
+		local = ":" + local
+	}
+	return &Tunnel{Name: f.Name, Local: local, Remote: f.Remote, client: client, done: make(chan struct{})}, nil
+}
+
+// Start keeps the SSH connection up and forwards connections in the
+// background until the tunnel is closed.
+func (t *Tunnel) Start() {
+	tunnelsMu.Lock()
+	tunnels = append(tunnels, t)
+	tunnelsMu.Unlock()
+	go t.supervise()
+	go t.serve()
+}
+
+// Close stops listening and drops the SSH connection.
+func (t *Tunnel) Close() {
+	close(t.done)
+	t.mu.Lock()
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	t.mu.Unlock()
+	t.client.Close()
+
+	tunnelsMu.Lock()
+	for i, o := range tunnels {
+		if o == t {
+			tunnels = append(tunnels[:i], tunnels[i+1:]...)
+			break
+		}
+	}
+	tunnelsMu.Unlock()
+}
+
+// Addr is the address the tunnel is listening on, nil until it is.
+func (t *Tunnel) Addr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.listener == nil {
+		return nil
+	}
+	return t.listener.Addr()
+}
+
+// sleep waits for the backoff and doubles it, returning false if the tunnel
+// was closed meanwhile.
+func (t *Tunnel) sleep(backoff *time.Duration) bool {
+	select {
+	case <-t.done:
+		return false
+	case <-time.After(*backoff):
+	}
+	if *backoff *= 2; *backoff > tunnelBackoffMax {
+		*backoff = tunnelBackoffMax
+	}
+	return true
+}
+
+func (t *Tunnel) setState(up bool, err error) {
+	t.mu.Lock()
+	t.up, t.err = up, err
+	t.mu.Unlock()
+	updateTitle()
+}
+
+// supervise dials the host and waits for the connection to drop, over and
+// over, with the backoff between one connection and the next.
+func (t *Tunnel) supervise() {
+	backoff := tunnelBackoffMin
+	for {
+		select {
+		case <-t.done:
+			return
+		default:
+		}
+		if err := t.client.connect(); err != nil {
+			t.setState(false, err)
+			if !t.sleep(&backoff) {
+				return
+			}
+			continue
+		}
+		connected := time.Now()
+		atomic.AddInt64(&t.connects, 1)
+		t.setState(true, nil)
+
+		t.client.mu.Lock()
+		conn := t.client.client
+		t.client.mu.Unlock()
+		if conn != nil {
+			err := conn.Wait()
+			log.Printf("tunnel %s: connection to %s lost: %v\n", t.Name, t.client.Addr, err)
+			t.setState(false, fmt.Errorf("connection lost"))
+			t.client.drop(conn)
+		}
+		if time.Since(connected) >= tunnelStable {
+			backoff = tunnelBackoffMin
+		}
+		if !t.sleep(&backoff) {
+			return
+		}
+	}
+}
+
+// serve listens on the local address, trying again with backoff when the
+// address cannot be had or stops accepting, and forwards each connection.
+func (t *Tunnel) serve() {
+	backoff := tunnelBackoffMin
+	for {
+		ln, err := net.Listen("tcp", t.Local)
+		t.mu.Lock()
+		t.listenErr = err
+		t.mu.Unlock()
+		if err != nil {
+			log.Printf("tunnel %s: %v\n", t.Name, err)
+			updateTitle()
+			if !t.sleep(&backoff) {
+				return
+			}
+			continue
+		}
+		t.mu.Lock()
+		select {
+		case <-t.done:
+			t.mu.Unlock()
+			ln.Close()
+			return
+		default:
+		}
+		t.listener = ln
+		t.mu.Unlock()
+		updateTitle()
+
+		var delay time.Duration
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				select {
+				case <-t.done:
+					return
+				default:
+				}
+				if ne, ok := err.(net.Error); ok && (ne.Timeout() || ne.Temporary()) {
+					if delay *= 2; delay == 0 {
+						delay = acceptDelayMin
+					} else if delay > acceptDelayMax {
+						delay = acceptDelayMax
+					}
+					log.Printf("tunnel %s: %v, accepting again in %v\n", t.Name, err, delay)
+					select {
+					case <-t.done:
+						return
+					case <-time.After(delay):
+					}
+					continue
+				}
+				log.Printf("tunnel %s: %v\n", t.Name, err)
+				break
+			}
+			// The address is working, so a later failure starts afresh
+			delay, backoff = 0, tunnelBackoffMin
+			go t.forward(conn)
+		}
+		t.mu.Lock()
+		t.listener = nil
+		t.mu.Unlock()
+		ln.Close()
+		if !t.sleep(&backoff) {
+			return
+		}
+	}
+}
+
+// forward copies both ways between the local connection and the remote
+// address.  When the remote end is done the local connection is closed; when
+// the local end is done the remote end is told there is no more to read.
+func (t *Tunnel) forward(lconn net.Conn) {
+	defer lconn.Close()
+	atomic.AddInt64(&t.accepted, 1)
+	atomic.AddInt64(&t.active, 1)
+	updateTitle()
+	defer func() {
+		atomic.AddInt64(&t.active, -1)
+		updateTitle()
+	}()
+
+	rconn, err := t.client.Dial("tcp", t.Remote)
+	if err != nil {
+		atomic.AddInt64(&t.failed, 1)
+		log.Printf("tunnel %s: dial %s: %v\n", t.Name, t.Remote, err)
+		return
+	}
+	defer rconn.Close()
+
+	go func() {
+		n, _ := io.Copy(rconn, lconn)
+		atomic.AddInt64(&t.sent, n)
+		if cw, ok := rconn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	n, _ := io.Copy(lconn, rconn)
+	atomic.AddInt64(&t.received, n)
+}
+
+// Dial opens a connection to the address from the host, dialing the host
+// again should the connection to it have dropped.
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	for i := 0; ; i++ {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		client := c.client
+		c.mu.Unlock()
+
+		conn, err := client.Dial(network, addr)
+		if _, refused := err.(*ssh.OpenChannelError); err == nil || refused || i > 0 {
+			return conn, err
+		}
+		if err := c.reconnect(client); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// status is how the tunnel is doing, for the process title.
+func (t *Tunnel) status() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := fmt.Sprintf("%s %s->%s", t.Name, t.Local, t.Remote)
+	switch {
+	case t.listenErr != nil:
+		return s + " error: " + t.listenErr.Error()
+	case !t.up && t.err != nil:
+		return s + " down: " + t.err.Error()
+	case !t.up:
+		return s + " connecting"
+	}
+	return fmt.Sprintf("%s up, %d open", s, atomic.LoadInt64(&t.active))
+}
+
+// The process title is set by the server and followed by the state of the
+// tunnels.
+var (
+	titleMu   sync.Mutex
+	titleBase = "node-stats"
+)
+
+// setTitle sets the start of the process title.
+func setTitle(base string) {
+	titleMu.Lock()
+	titleBase = base
+	titleMu.Unlock()
+	updateTitle()
+}
+
+// updateTitle shows the state of the tunnels in the process title.
+func updateTitle() {
+	tunnelsMu.Lock()
+	var states []string
+	for _, t := range tunnels {
+		states = append(states, t.status())
+	}
+	tunnelsMu.Unlock()
+
+	titleMu.Lock()
+	defer titleMu.Unlock()
+	title := titleBase
+	if len(states) > 0 {
+		title += "; tunnel " + strings.Join(states, ", ")
+	}
+	SetProcessName(title)
+}
+
+// CollectTunnel reports the health and traffic of the tunnels.  They are
+// those of this process, so they are left out of collections from a remote
+// host.
+func (m *Metrics) CollectTunnel() error {
+	if m.Client != nil {
+		return nil
+	}
+
+	tunnelsMu.Lock()
+	list := append([]*Tunnel(nil), tunnels...)
+	tunnelsMu.Unlock()
+	if len(list) == 0 {
+		return nil
+	}
+
+	for _, t := range list {
+		lbl := Labels{"tunnel": t.Name}
+		t.mu.Lock()
+		up, listening := t.up, t.listener != nil
+		t.mu.Unlock()
+		m.PrintType("node_tunnel_up", "gauge", "1 if the SSH connection of the tunnel is up")
+		m.PrintBool(lbl, up)
+		m.PrintType("node_tunnel_listening", "gauge", "1 if the tunnel is listening on its local address")
+		m.PrintBool(lbl, listening)
+		m.PrintType("node_tunnel_ssh_connects_total", "counter", "SSH connections made for the tunnel")
+		m.PrintInt(lbl, atomic.LoadInt64(&t.connects))
+		m.PrintType("node_tunnel_connections_total", "counter", "Connections accepted by the tunnel")
+		m.PrintInt(lbl, atomic.LoadInt64(&t.accepted))
+		m.PrintType("node_tunnel_failed_connections_total", "counter", "Connections the remote address could not be dialed for")
+		m.PrintInt(lbl, atomic.LoadInt64(&t.failed))
+		m.PrintType("node_tunnel_open_connections", "gauge", "Connections being forwarded")
+		m.PrintInt(lbl, atomic.LoadInt64(&t.active))
+		m.PrintType("node_tunnel_sent_bytes_total", "counter", "Bytes sent on to the remote address")
+		m.PrintInt(lbl, atomic.LoadInt64(&t.sent))
+		m.PrintType("node_tunnel_received_bytes_total", "counter", "Bytes received from the remote address")
+		m.PrintInt(lbl, atomic.LoadInt64(&t.received))
+	}
+	return nil
+}
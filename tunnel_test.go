@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startEcho runs a server which writes back each line it is sent.
+func startEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(line))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// waitFor polls until the condition holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestTunnel(t *testing.T) {
+	addr, _ := startSSHServer(t)
+	tunnel, err := NewTunnel(Forward{Target: testTarget(t, addr), Local: "127.0.0.1:0", Remote: startEcho(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel.Name = "echo"
+	tunnelBackoffMin = 10 * time.Millisecond
+	defer func() { tunnelBackoffMin = time.Second }()
+	tunnel.Start()
+	defer tunnel.Close()
+	waitFor(t, "the tunnel", func() bool { return tunnel.Addr() != nil && strings.HasSuffix(tunnel.status(), "up, 0 open") })
+
+	echo := func() {
+		t.Helper()
+		conn, err := net.Dial("tcp", tunnel.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello\n"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "hello\n" {
+			t.Errorf("read %q, %v", line, err)
+		}
+	}
+	echo()
+
+	// The SSH connection drops and comes back
+	tunnel.client.Close()
+	waitFor(t, "the reconnect", func() bool { return atomic.LoadInt64(&tunnel.connects) == 2 })
+	echo()
+	waitFor(t, "the connections to close", func() bool { return atomic.LoadInt64(&tunnel.active) == 0 })
+
+	m := &Metrics{}
+	if err := m.CollectTunnel(); err != nil {
+		t.Fatal(err)
+	}
+	s := m.String()
+	for _, want := range []string{
+		`node_tunnel_up{tunnel="echo"} 1`,
+		`node_tunnel_ssh_connects_total{tunnel="echo"} 2`,
+		`node_tunnel_connections_total{tunnel="echo"} 2`,
+		`node_tunnel_sent_bytes_total{tunnel="echo"} 12`,
+		`node_tunnel_received_bytes_total{tunnel="echo"} 12`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("missing %q in:\n%s", want, s)
+		}
+	}
+
+	remote := &Metrics{Client: tunnel.client}
+	if err := remote.CollectTunnel(); err != nil {
+		t.Fatal(err)
+	}
+	if s := remote.String(); strings.Contains(s, "node_tunnel_") {
+		t.Errorf("tunnels reported for a remote host:\n%s", s)
+	}
+}
+
+func TestTunnelRefused(t *testing.T) {
+	addr, _ := startSSHServer(t)
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := ln.Addr().String()
+	ln.Close()
+	tunnel, err := NewTunnel(Forward{Target: testTarget(t, addr), Local: "127.0.0.1:0", Remote: closed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel.Start()
+	defer tunnel.Close()
+	waitFor(t, "the tunnel", func() bool { return tunnel.Addr() != nil })
+
+	conn, err := net.Dial("tcp", tunnel.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("read %d, %v from a refused tunnel", n, err)
+	}
+	conn.Close()
+	waitFor(t, "the failure count", func() bool { return atomic.LoadInt64(&tunnel.failed) == 1 })
+	if n := atomic.LoadInt64(&tunnel.connects); n != 1 {
+		t.Errorf("a refused connection dialed the host again: %d connects", n)
+	}
+}
+
+func TestForwardLocal(t *testing.T) {
+	tunnel, err := NewTunnel(Forward{Target: Target{Host: "bastion"}, Local: strconv.Itoa(9101), Remote: "10.0.0.1:9100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.Local != ":9101" {
+		t.Errorf("Local = %q", tunnel.Local)
+	}
+}